@@ -1,8 +1,10 @@
-import React from 'react';
+import React, { useState } from 'react';
 import { useTranslation } from 'react-i18next';
+import { errorMessages } from './errors';
 
 const IdealForm = () => {
   const { t, i18n } = useTranslation();
+  const [error, setError] = useState(null);
 
   const handleSubmit = async (e) => {
     // We don't want to let default form submission happen here,
@@ -23,6 +25,10 @@ const IdealForm = () => {
       }
     );
     const data = await response.json()
+    if (!response.ok) {
+      setError(errorMessages[data.error] ?? 'error');
+      return;
+    }
     window.location = data.issuer_authentication_url
   };
 
@@ -40,6 +46,8 @@ const IdealForm = () => {
 
             <p className='details'>*{t('minimum')}</p>
 
+            {error && <p>{t(error)}</p>}
+
           </div>
         </main>
         <footer>
@@ -1,10 +1,12 @@
 import React, { useEffect, useState } from 'react';
 import { Link } from 'react-router-dom';
 import { useTranslation } from 'react-i18next';
+import { errorMessages } from './errors';
 
 const IssueCredential = () => {
     const [statusResponse, setStatusResponse] = useState(null);
     const [error, setError] = useState(false);
+    const [errorResponse, setErrorResponse] = useState(null);
     const [done, setDone] = useState(false);
 
     const { t, i18n } = useTranslation();
@@ -29,6 +31,11 @@ const IssueCredential = () => {
                     }
                 );
                 const data = await response.json();
+                if (!response.ok) {
+                    setErrorResponse(data);
+                    setError(true);
+                    return;
+                }
                 setStatusResponse(data);
             }
         };
@@ -52,15 +59,25 @@ const IssueCredential = () => {
                     element: '#yivi-web-form',
 
                     // Back-end options
-                    session: {
-                        url: statusResponse.irma_server_url,
-
-                        start: {
-                            method: 'POST',
-                            body: statusResponse.jwt,
-                            headers: { 'Content-Type': 'text/plain' },
+                    session: statusResponse.session_ptr
+                        // The backend already started the session, we only get the pointer to it.
+                        ? {
+                            start: false,
+                            mapping: {
+                                sessionPtr: () => statusResponse.session_ptr,
+                                frontendRequest: () => statusResponse.frontend_request,
+                            },
+                            result: false,
+                        }
+                        : {
+                            url: statusResponse.irma_server_url,
+
+                            start: {
+                                method: 'POST',
+                                body: statusResponse.jwt,
+                                headers: { 'Content-Type': 'text/plain' },
+                            }
                         }
-                    }
                 });
                 web.start()
                     .then(() => {
@@ -76,6 +93,17 @@ const IssueCredential = () => {
     }, [statusResponse]);
 
     const showError = () => {
+        if (errorResponse) {
+            const key = errorMessages[errorResponse.error] ?? 'error';
+            return (
+                <>
+                    <p>{t(key)}</p>
+                    {errorResponse.request_id && (
+                        <p className='details'>{t('request_id')}: {errorResponse.request_id}</p>
+                    )}
+                </>
+            );
+        }
         switch (statusResponse?.transaction_status?.status) {
             case 'failure':
                 return <p>{t('failure')}</p>;
@@ -0,0 +1,15 @@
+// Maps the error codes returned by the backend to translation keys.
+export const errorMessages = {
+    'error:transaction-not-found': 'error_transaction_not_found',
+    'error:iban-provider-unavailable': 'error_iban_provider_unavailable',
+    'error:storage-unavailable': 'error_storage_unavailable',
+    'error:jwt-signing': 'error_jwt_signing',
+    'error:irma-session': 'error_jwt_signing',
+    'error:malformed-request': 'error_malformed_request',
+    'error:invalid-language': 'error_invalid_language',
+    'error:already-issued': 'error_already_issued',
+    'error:session-mismatch': 'error_session_mismatch',
+    'error:ratelimit': 'error_ratelimit',
+    'error:invalid-iban': 'error_invalid_iban',
+    'error:unknown-bank': 'error_unknown_bank',
+};
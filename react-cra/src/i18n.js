@@ -30,6 +30,18 @@ i18n
 
                     thank_you: "Thank you for using Yivi, you can close this page now.",
 
+                    request_id: "Reference",
+                    error_transaction_not_found: "This iDEAL transaction could not be found or has already been used, please try again.",
+                    error_iban_provider_unavailable: "The iDEAL provider could not be reached, please try again later.",
+                    error_storage_unavailable: "The service is temporarily unavailable, please try again later.",
+                    error_jwt_signing: "The credential could not be prepared, please try again later.",
+                    error_malformed_request: "The request was invalid, please try again.",
+                    error_invalid_language: "This language is not supported.",
+                    error_ratelimit: "Too many attempts, please wait a moment and try again.",
+                    error_already_issued: "This IBAN was already added to your Yivi app.",
+                    error_session_mismatch: "Please finish the verification in the same browser in which you started it.",
+                    error_invalid_iban: "Your bank returned an account number that is not a valid IBAN, so no credential can be issued.",
+                    error_unknown_bank: "Your bank is not supported yet, so no credential can be issued.",
                 }
             },
             nl: {
@@ -51,6 +63,19 @@ i18n
                     qr: "Scan de QR-code hieronder om deze informatie aan Yivi toe te voegen.",
 
                     thank_you: "Bedankt voor het gebruik van Yivi, u kunt deze pagina nu sluiten.",
+
+                    request_id: "Referentie",
+                    error_transaction_not_found: "Deze iDEAL-transactie kon niet worden gevonden of is al gebruikt. Probeer het opnieuw.",
+                    error_iban_provider_unavailable: "De iDEAL-aanbieder is niet bereikbaar. Probeer het later opnieuw.",
+                    error_storage_unavailable: "De dienst is tijdelijk niet beschikbaar. Probeer het later opnieuw.",
+                    error_jwt_signing: "De gegevens konden niet worden voorbereid. Probeer het later opnieuw.",
+                    error_malformed_request: "Het verzoek was ongeldig. Probeer het opnieuw.",
+                    error_invalid_language: "Deze taal wordt niet ondersteund.",
+                    error_ratelimit: "Te veel pogingen. Wacht even en probeer het opnieuw.",
+                    error_already_issued: "Deze IBAN is al toegevoegd aan uw Yivi-app.",
+                    error_session_mismatch: "Rond de verificatie af in dezelfde browser waarin u deze bent gestart.",
+                    error_invalid_iban: "Uw bank gaf een rekeningnummer terug dat geen geldige IBAN is. Er kan geen credential worden uitgegeven.",
+                    error_unknown_bank: "Uw bank wordt nog niet ondersteund. Er kan geen credential worden uitgegeven.",
                 }
             }
         },
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"yivi-iban-issuer/bankdir"
+	log "yivi-iban-issuer/logging"
+)
+
+// ErrUnknownBank is returned when no BIC can be derived for the account, in which
+// case no credential is issued rather than one with an empty or made up bic
+var ErrUnknownBank = errors.New("bank of the account is unknown")
+
+// resolveBank derives the BIC and bank name of the verified account. The bank code in the IBAN
+// is leading, because the iDEAL issuer id isn't necessarily a BIC. The issuer id is cross-checked
+// against it and only used when the bank of the IBAN isn't in the directory.
+func resolveBank(ctx context.Context, directory *bankdir.Directory, status *TransactionStatus) (bic string, bankName string, err error) {
+	ibanBank, ibanKnown := directory.ByIban(status.IBAN)
+	issuerBank, issuerKnown := directory.ByIdealIssuerId(status.IssuerID)
+
+	if ibanKnown {
+		if issuerKnown && issuerBank.BIC != ibanBank.BIC {
+			log.Warn(ctx, "iDEAL issuer doesn't match the bank of the iban, using the bic of the iban", "issuer_bic", issuerBank.BIC, "iban_bic", ibanBank.BIC)
+		}
+		return ibanBank.BIC, ibanBank.Name, nil
+	}
+	if issuerKnown {
+		return issuerBank.BIC, issuerBank.Name, nil
+	}
+	if bankdir.IsValidBic(status.IssuerID) {
+		log.Info(ctx, "bank of iDEAL issuer is not in the bank directory, using the issuer id as bic", "issuer_id", status.IssuerID)
+		return status.IssuerID, "", nil
+	}
+
+	return "", "", fmt.Errorf("%w: iDEAL issuer id %q is not in the bank directory and not a bic", ErrUnknownBank, status.IssuerID)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestResolveBank(t *testing.T) {
+	directory := newTestBankDirectory(t)
+
+	tests := []struct {
+		name     string
+		iban     string
+		issuerId string
+		bic      string
+		bankName string
+	}{
+		{"bank of iban", "NL91ABNA0417164300", "ABNANL2A", "ABNANL2A", "ABN AMRO"},
+		{"iban wins over mismatching issuer", "NL91ABNA0417164300", "INGBNL2A", "ABNANL2A", "ABN AMRO"},
+		{"issuer when iban bank is unknown", "LT121000011101001000", "REVOLT21", "REVOLT21", "Revolut"},
+		{"issuer id that is a bic", "FR1420041010050500013M02606", "PSSTFRPP", "PSSTFRPP", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bic, bankName, err := resolveBank(context.Background(), directory, &TransactionStatus{IBAN: tc.iban, IssuerID: tc.issuerId})
+			if err != nil {
+				t.Fatalf("failed to resolve bank: %v", err)
+			}
+			if bic != tc.bic || bankName != tc.bankName {
+				t.Errorf("expected %v %v, got %v %v", tc.bic, tc.bankName, bic, bankName)
+			}
+		})
+	}
+}
+
+func TestResolveBankRefusesUnknownBank(t *testing.T) {
+	_, _, err := resolveBank(context.Background(), newTestBankDirectory(t),
+		&TransactionStatus{IBAN: "FR1420041010050500013M02606", IssuerID: "issuer-1"})
+	if !errors.Is(err, ErrUnknownBank) {
+		t.Errorf("expected ErrUnknownBank, got %v", err)
+	}
+}
+
+func TestStatusRefusesToIssueWithoutBic(t *testing.T) {
+	storage := newTestTokenStorage(t)
+	cookie := storeStartedTransaction(t, storage, "trx")
+	status := successStatus("trx")
+	status.IBAN = "FR1420041010050500013M02606"
+	status.IssuerID = "issuer-1"
+
+	server := newTestServer(t, &ServerState{
+		ibanChecker:   &stubIbanChecker{status: status},
+		jwtCreator:    stubJwtCreator{},
+		tokenStorage:  storage,
+		bankDirectory: newTestBankDirectory(t),
+	})
+
+	resp := postJson(t, server.URL+"/api/status", `{"transaction_id": "trx"}`, cookie)
+	assertErrorResponse(t, resp, http.StatusBadGateway, ErrorUnknownBank)
+
+	record, _ := storage.RetrieveTransaction(context.Background(), "trx")
+	if record.JwtIssued {
+		t.Error("transaction shouldn't be claimed when no credential is issued")
+	}
+}
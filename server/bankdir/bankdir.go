@@ -0,0 +1,107 @@
+package bankdir
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The directory that is used when no other directory is configured
+//
+//go:embed banks.json
+var embeddedBanks []byte
+
+type Bank struct {
+	BIC     string `json:"bic"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	// Codes that identify the bank in the IBANs it hands out
+	BankCodes []string `json:"bank_codes"`
+	// Identifiers of the bank in iDEAL
+	IdealIssuerIds []string `json:"ideal_issuer_ids"`
+}
+
+// Position of the bank code in the IBAN, per country for which it's known
+var bankCodePositions = map[string][2]int{
+	"AT": {4, 9},
+	"BE": {4, 7},
+	"DE": {4, 12},
+	"LU": {4, 7},
+	"NL": {4, 8},
+}
+
+var bicPattern = regexp.MustCompile(`^[A-Z]{6}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+
+// IsValidBic checks the format of a BIC, being either 8 or 11 characters long
+func IsValidBic(bic string) bool {
+	return bicPattern.MatchString(bic)
+}
+
+// Directory looks up banks by the bank code in an IBAN or by their iDEAL issuer id
+type Directory struct {
+	byBankCode      map[string]*Bank
+	byIdealIssuerId map[string]*Bank
+}
+
+// Embedded returns the directory that is compiled into the binary
+func Embedded() (*Directory, error) {
+	return Parse(embeddedBanks)
+}
+
+// Load reads a directory from a JSON file with the same format as the embedded banks.json,
+// so the directory can be updated without a new release
+func Load(path string) (*Directory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Directory, error) {
+	var banks []*Bank
+	err := json.Unmarshal(data, &banks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bank directory: %w", err)
+	}
+
+	directory := &Directory{
+		byBankCode:      make(map[string]*Bank),
+		byIdealIssuerId: make(map[string]*Bank),
+	}
+	for _, bank := range banks {
+		if !IsValidBic(bank.BIC) {
+			return nil, fmt.Errorf("bank %v has an invalid bic: %v", bank.Name, bank.BIC)
+		}
+		for _, code := range bank.BankCodes {
+			directory.byBankCode[bank.Country+code] = bank
+		}
+		for _, issuerId := range bank.IdealIssuerIds {
+			directory.byIdealIssuerId[issuerId] = bank
+		}
+	}
+	return directory, nil
+}
+
+// ByIban finds the bank that handed out the normalized IBAN
+func (d *Directory) ByIban(iban string) (*Bank, bool) {
+	if len(iban) < 2 {
+		return nil, false
+	}
+	country := iban[:2]
+	position, ok := bankCodePositions[country]
+	if !ok || len(iban) < position[1] {
+		return nil, false
+	}
+	bank, ok := d.byBankCode[country+iban[position[0]:position[1]]]
+	return bank, ok
+}
+
+// ByIdealIssuerId finds the bank with the given iDEAL issuer id
+func (d *Directory) ByIdealIssuerId(issuerId string) (*Bank, bool) {
+	bank, ok := d.byIdealIssuerId[strings.ToUpper(strings.TrimSpace(issuerId))]
+	return bank, ok
+}
@@ -0,0 +1,106 @@
+package bankdir
+
+import "testing"
+
+const testBanks = `[
+	{"bic": "BKAUATWW", "name": "Bank Austria", "country": "AT", "bank_codes": ["19043"]},
+	{"bic": "GEBABEBB", "name": "BNP Paribas Fortis", "country": "BE", "bank_codes": ["539"]},
+	{"bic": "COBADEFF", "name": "Commerzbank", "country": "DE", "bank_codes": ["37040044"]},
+	{"bic": "BCEELULL", "name": "Spuerkeess", "country": "LU", "bank_codes": ["001"]},
+	{"bic": "ABNANL2A", "name": "ABN AMRO", "country": "NL", "bank_codes": ["ABNA"], "ideal_issuer_ids": ["ABNANL2A"]}
+]`
+
+func TestByIbanUsesBankCodePositionOfCountry(t *testing.T) {
+	directory, err := Parse([]byte(testBanks))
+	if err != nil {
+		t.Fatalf("failed to parse directory: %v", err)
+	}
+
+	tests := []struct {
+		iban string
+		bic  string
+	}{
+		{"AT611904300234573201", "BKAUATWW"},
+		{"BE68539007547034", "GEBABEBB"},
+		{"DE89370400440532013000", "COBADEFF"},
+		{"LU280019400644750000", "BCEELULL"},
+		{"NL91ABNA0417164300", "ABNANL2A"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.iban, func(t *testing.T) {
+			bank, ok := directory.ByIban(tc.iban)
+			if !ok || bank.BIC != tc.bic {
+				t.Errorf("expected %v, got %+v", tc.bic, bank)
+			}
+		})
+	}
+}
+
+func TestByIbanUnknownBanks(t *testing.T) {
+	directory, err := Parse([]byte(testBanks))
+	if err != nil {
+		t.Fatalf("failed to parse directory: %v", err)
+	}
+
+	for _, iban := range []string{
+		// Bank code that isn't in the directory
+		"NL02RABO0123456789",
+		// Country of which the bank code position isn't known
+		"FR1420041010050500013M02606",
+		// Too short to hold a bank code
+		"NL91AB",
+		"N",
+		"",
+	} {
+		if bank, ok := directory.ByIban(iban); ok {
+			t.Errorf("%q shouldn't be found, got %+v", iban, bank)
+		}
+	}
+}
+
+func TestByIdealIssuerIdIsNormalized(t *testing.T) {
+	directory, err := Parse([]byte(testBanks))
+	if err != nil {
+		t.Fatalf("failed to parse directory: %v", err)
+	}
+
+	if bank, ok := directory.ByIdealIssuerId(" abnanl2a "); !ok || bank.BIC != "ABNANL2A" {
+		t.Errorf("issuer id should be matched case insensitively, got %+v", bank)
+	}
+	if _, ok := directory.ByIdealIssuerId("RABONL2U"); ok {
+		t.Error("unknown issuer id shouldn't be found")
+	}
+}
+
+func TestParseRejectsInvalidBic(t *testing.T) {
+	_, err := Parse([]byte(`[{"bic": "ABNA", "name": "ABN AMRO", "country": "NL", "bank_codes": ["ABNA"]}]`))
+	if err == nil {
+		t.Error("directory with an invalid bic should be rejected")
+	}
+}
+
+func TestIsValidBic(t *testing.T) {
+	tests := map[string]bool{
+		"ABNANL2A":    true,
+		"INGBNL2AXXX": true,
+		"abnanl2a":    false,
+		"ABNANL2":     false,
+		"ABNANL2AXX":  false,
+		"1BNANL2A":    false,
+	}
+	for bic, valid := range tests {
+		if IsValidBic(bic) != valid {
+			t.Errorf("expected %v to be valid %v", bic, valid)
+		}
+	}
+}
+
+func TestEmbeddedDirectory(t *testing.T) {
+	directory, err := Embedded()
+	if err != nil {
+		t.Fatalf("embedded directory should be valid: %v", err)
+	}
+	if bank, ok := directory.ByIban("NL69INGB0123456789"); !ok || bank.BIC != "INGBNL2A" {
+		t.Errorf("embedded directory should know ING, got %+v", bank)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the provider while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open, provider is degraded")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// A single trial call is let through to check whether the provider recovered
+	circuitHalfOpen
+)
+
+// circuitBreaker opens after a number of consecutive failures, so callers fail fast
+// instead of piling up on a degraded provider. After the cooldown one trial call
+// decides whether it closes again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	// Called with whether the circuit is open whenever that changes
+	onChange func(open bool)
+
+	mutex    sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, onChange func(open bool)) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		onChange:  onChange,
+	}
+}
+
+// Allow returns ErrCircuitOpen when the call shouldn't be made
+func (b *circuitBreaker) Allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		// The trial call is still running
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// Release gives up an allowed call without an outcome, e.g. because the caller cancelled it.
+// When it was the trial call, the next call after it becomes the trial call.
+func (b *circuitBreaker) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		// Let the next call through right away, the cooldown already passed
+		b.openedAt = b.now().Add(-b.cooldown)
+	}
+}
+
+// Record reports the outcome of an allowed call
+func (b *circuitBreaker) Record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasOpen := b.state != circuitClosed
+	if success {
+		b.state = circuitClosed
+		b.failures = 0
+	} else {
+		b.failures++
+		if b.state == circuitHalfOpen || b.failures >= b.threshold {
+			b.state = circuitOpen
+			b.openedAt = b.now()
+		}
+	}
+
+	isOpen := b.state != circuitClosed
+	if isOpen != wasOpen && b.onChange != nil {
+		b.onChange(isOpen)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestCircuitBreaker(threshold int, cooldown time.Duration) (*circuitBreaker, *testClock, *[]bool) {
+	clock := newTestClock()
+	var changes []bool
+	breaker := newCircuitBreaker(threshold, cooldown, func(open bool) { changes = append(changes, open) })
+	breaker.now = clock.Now
+	return breaker, clock, &changes
+}
+
+// fail makes the given number of allowed calls fail
+func fail(t *testing.T, breaker *circuitBreaker, calls int) {
+	t.Helper()
+	for range calls {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("call should be allowed: %v", err)
+		}
+		breaker.Record(false)
+	}
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker, _, changes := newTestCircuitBreaker(3, time.Minute)
+
+	fail(t, breaker, 2)
+	breaker.Allow()
+	breaker.Record(true)
+	fail(t, breaker, 2)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("a success should reset the consecutive failures: %v", err)
+	}
+	breaker.Record(false)
+
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("circuit should be open after the threshold, got %v", err)
+	}
+	if len(*changes) != 1 || !(*changes)[0] {
+		t.Errorf("opening should be reported once, got %v", *changes)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	breaker, clock, changes := newTestCircuitBreaker(1, time.Minute)
+	fail(t, breaker, 1)
+
+	clock.Advance(59 * time.Second)
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("circuit should stay open during the cooldown, got %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("trial call should be allowed after the cooldown: %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("only one trial call should be allowed, got %v", err)
+	}
+
+	breaker.Record(false)
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("failed trial call should open the circuit again, got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	breaker.Allow()
+	breaker.Record(true)
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("successful trial call should close the circuit: %v", err)
+	}
+	if len(*changes) != 2 || !(*changes)[0] || (*changes)[1] {
+		t.Errorf("expected open and close to be reported, got %v", *changes)
+	}
+}
+
+func TestCircuitBreakerReleasedTrialStaysOpen(t *testing.T) {
+	breaker, clock, _ := newTestCircuitBreaker(1, time.Minute)
+	fail(t, breaker, 1)
+	clock.Advance(time.Minute)
+
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("trial call should be allowed: %v", err)
+	}
+	breaker.Release()
+
+	if breaker.state == circuitClosed {
+		t.Fatal("released trial call shouldn't close the circuit")
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("next call should become the trial call: %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("only one trial call should be allowed, got %v", err)
+	}
+}
+
+func TestCmCancelledTrialCallKeepsCircuitOpen(t *testing.T) {
+	server, received := newBlockingCmServer(t)
+	checker := newTestCmIbanChecker(t, server, CmIbanConfig{CircuitBreakerThreshold: 1})
+	clock := newTestClock()
+	checker.client.breaker.now = clock.Now
+
+	// CM failed before, so the circuit is open and the cooldown passed
+	checker.client.breaker.Allow()
+	checker.client.breaker.Record(false)
+	clock.Advance(defaultCmCircuitBreakerCooldown)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	_, err := checker.GetStatus(ctx, "ref", "trx")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if checker.client.breaker.state == circuitClosed {
+		t.Error("trial call cancelled by the client shouldn't close the circuit")
+	}
+}
+
+func TestCmCircuitOpensOnServerErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	checker := newTestCmIbanChecker(t, server, CmIbanConfig{RetryBackoffMs: 1, CircuitBreakerThreshold: 3})
+
+	_, err := checker.GetStatus(context.Background(), "ref", "trx")
+	var responseErr *CmResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a CmResponseError with status 500, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("status poll should be tried three times, got %v", calls)
+	}
+
+	_, err = checker.GetStatus(context.Background(), "ref", "trx")
+	if !errors.Is(err, ErrCircuitOpen) || calls != 3 {
+		t.Errorf("open circuit should fail fast without calling CM, got %v after %v calls", err, calls)
+	}
+	if code, errorCode := errorResponse(err); code != http.StatusBadGateway || errorCode != ErrorIbanProviderUnavailable {
+		t.Errorf("open circuit should map to %v, got %v %v", ErrorIbanProviderUnavailable, code, errorCode)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+	log "yivi-iban-issuer/logging"
+)
+
+const (
+	defaultCmMaxIdleConns            = 10
+	defaultCmStatusRetries           = 2
+	defaultCmRetryBackoff            = 200 * time.Millisecond
+	defaultCmCircuitBreakerThreshold = 5
+	defaultCmCircuitBreakerCooldown  = 30 * time.Second
+	cmIdleConnTimeout                = 90 * time.Second
+	// Error bodies of CM are kept up to this size
+	maxCmErrorBodySize = 1024
+)
+
+// CmResponseError is returned when CM responds with a non-2xx status, it carries CM's error body
+type CmResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *CmResponseError) Error() string {
+	return fmt.Sprintf("CM responded with status %v: %v", e.StatusCode, e.Body)
+}
+
+// retryable tells whether the same request may succeed when it's sent again
+func (e *CmResponseError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// cmClient sends the requests to CM over a shared, pooled transport. Idempotent calls
+// are retried and a circuit breaker stops calling CM while it's degraded.
+type cmClient struct {
+	baseUrl string
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	http    *http.Client
+	breaker *circuitBreaker
+}
+
+func newCmClient(config CmIbanConfig) *cmClient {
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultCmMaxIdleConns
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.IdleConnTimeout = cmIdleConnTimeout
+
+	retries := defaultCmStatusRetries
+	if config.StatusRetries != nil {
+		retries = *config.StatusRetries
+	}
+	backoff := defaultCmRetryBackoff
+	if config.RetryBackoffMs > 0 {
+		backoff = time.Duration(config.RetryBackoffMs) * time.Millisecond
+	}
+	threshold := defaultCmCircuitBreakerThreshold
+	if config.CircuitBreakerThreshold > 0 {
+		threshold = config.CircuitBreakerThreshold
+	}
+	cooldown := defaultCmCircuitBreakerCooldown
+	if config.CircuitBreakerCooldownMs > 0 {
+		cooldown = time.Duration(config.CircuitBreakerCooldownMs) * time.Millisecond
+	}
+
+	return &cmClient{
+		baseUrl: config.BaseUrl,
+		timeout: time.Duration(config.TimeoutMs) * time.Millisecond,
+		retries: retries,
+		backoff: backoff,
+		http:    &http.Client{Transport: transport},
+		breaker: newCircuitBreaker(threshold, cooldown, func(open bool) {
+			if open {
+				cmCircuitOpen.Set(1)
+				log.Warn(context.Background(), "CM circuit breaker opened, failing fast")
+			} else {
+				cmCircuitOpen.Set(0)
+				log.Info(context.Background(), "CM circuit breaker closed")
+			}
+		}),
+	}
+}
+
+// call sends the request to the endpoint and returns the body of a 2xx response.
+// Only idempotent calls are retried, with jittered exponential backoff.
+func (c *cmClient) call(ctx context.Context, method string, endpoint string, body []byte, idempotent bool) ([]byte, error) {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if !c.wait(ctx, attempt) {
+				return nil, errors.Join(err, ctx.Err())
+			}
+			cmRetries.WithLabelValues(endpoint).Inc()
+			log.Warn(ctx, "Retrying CM call", "endpoint", endpoint, "attempt", attempt+1, "error", err)
+		}
+
+		if err = c.breaker.Allow(); err != nil {
+			return nil, err
+		}
+
+		var response []byte
+		response, err = c.do(ctx, method, endpoint, body)
+		if ctx.Err() != nil {
+			// Cancelled by our side, which says nothing about the health of CM
+			c.breaker.Release()
+			return nil, err
+		}
+		degraded := cmDegraded(err)
+		c.breaker.Record(!degraded)
+		if err == nil {
+			return response, nil
+		}
+		// Only failures that say CM is degraded are worth another try
+		if !degraded {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// wait sleeps before the given retry, it returns false when the context ended first
+func (c *cmClient) wait(ctx context.Context, attempt int) bool {
+	backoff := c.backoff << (attempt - 1)
+	// Spread the retries between half and one and a half times the backoff
+	backoff = backoff/2 + rand.N(backoff)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (c *cmClient) do(ctx context.Context, method string, endpoint string, body []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		cmRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	}()
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if requestId := requestIdFrom(ctx); requestId != "" {
+		req.Header.Set(RequestIdHeader, requestId)
+	}
+
+	// Execute the request, the context carries the deadline
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	log.Info(ctx, "CM responded", "endpoint", endpoint, "status", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(response) > maxCmErrorBodySize {
+			response = response[:maxCmErrorBodySize]
+		}
+		return nil, &CmResponseError{StatusCode: resp.StatusCode, Body: string(response)}
+	}
+	return response, nil
+}
+
+// cmDegraded tells whether the error means CM is degraded, client errors say nothing about its health
+func cmDegraded(err error) bool {
+	if err == nil {
+		return false
+	}
+	var responseErr *CmResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.retryable()
+	}
+	return true
+}
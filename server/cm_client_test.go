@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCmIbanChecker creates a checker that talks to the test server over its TLS certificate
+func newTestCmIbanChecker(t *testing.T, server *httptest.Server, config CmIbanConfig) *CmIbanChecker {
+	t.Helper()
+	config.BaseUrl = server.URL + "/"
+	checker, err := NewCmIbanChecker(config)
+	if err != nil {
+		t.Fatalf("failed to create cm iban checker: %v", err)
+	}
+	transport := checker.client.http.Transport.(*http.Transport)
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	return checker
+}
+
+// newBlockingCmServer returns a CM server of which the requests only finish when the client goes away
+func newBlockingCmServer(t *testing.T) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client went away once the body has been read
+		io.Copy(io.Discard, r.Body)
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	// Cleanups run last in first out, so the handlers are released before the server is closed
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	return server, received
+}
+
+func TestCmCallIsCancelledWithTheRequest(t *testing.T) {
+	server, received := newBlockingCmServer(t)
+	checker := newTestCmIbanChecker(t, server, CmIbanConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := checker.GetStatus(ctx, "ref", "trx")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled call should return promptly, took %v", elapsed)
+	}
+	if len(received) != 0 {
+		t.Error("cancelled call shouldn't be retried")
+	}
+}
+
+func TestCmCallTimesOut(t *testing.T) {
+	server, _ := newBlockingCmServer(t)
+	zero := 0
+	checker := newTestCmIbanChecker(t, server, CmIbanConfig{TimeoutMs: 50, StatusRetries: &zero})
+
+	start := time.Now()
+	_, err := checker.GetStatus(context.Background(), "ref", "trx")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call should stop at the timeout, took %v", elapsed)
+	}
+}
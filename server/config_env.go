@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Prefix of the environment variables that override the config file
+const ConfigEnvPrefix = "IBAN_ISSUER_"
+
+// Suffix of the environment variables that contain the path of a file with the value,
+// e.g. a mounted Kubernetes or Docker secret
+const configEnvFileSuffix = "_FILE"
+
+// applyEnvOverrides overrides the fields of the config with the environment variables named after
+// their json path, e.g. IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN for cm_iban_config.merchant_token.
+// Strings are taken as is, all other values are parsed as JSON. The same variable with a _FILE suffix
+// reads the value from the file at that path instead.
+func applyEnvOverrides(config *Config, lookupEnv func(string) (string, bool)) error {
+	return applyEnvOverridesToStruct(reflect.ValueOf(config).Elem(), ConfigEnvPrefix, lookupEnv)
+}
+
+func applyEnvOverridesToStruct(value reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			err := applyEnvOverridesToStruct(value.Field(i), envName+"_", lookupEnv)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, source, ok, err := lookupEnvOrFile(envName, lookupEnv)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		err = setFieldFromString(value.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("invalid value in %v: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnvOrFile returns the value of the variable, or the contents of the file its _FILE variant points to
+func lookupEnvOrFile(envName string, lookupEnv func(string) (string, bool)) (value string, source string, ok bool, err error) {
+	if path, ok := lookupEnv(envName + configEnvFileSuffix); ok {
+		if _, ok := lookupEnv(envName); ok {
+			return "", "", false, fmt.Errorf("both %v and %v are set", envName, envName+configEnvFileSuffix)
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", false, fmt.Errorf("failed to read %v: %w", envName+configEnvFileSuffix, err)
+		}
+		// Secret files commonly end with a newline that isn't part of the value
+		return strings.TrimRight(string(contents), "\r\n"), envName + configEnvFileSuffix, true, nil
+	}
+
+	value, ok = lookupEnv(envName)
+	return value, envName, ok, nil
+}
+
+func setFieldFromString(field reflect.Value, raw string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(raw)
+		return nil
+	}
+
+	parsed := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(raw), parsed.Interface())
+	if err != nil {
+		return err
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "merchant_token")
+	if err := os.WriteFile(tokenPath, []byte("token-from-file\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret file: %v", err)
+	}
+
+	zero := 0
+	tests := []struct {
+		name string
+		env  map[string]string
+		// Expected config, compared to the base config with the overrides applied
+		expect func(config *Config)
+		// Part of the expected error, empty when the overrides should apply
+		err string
+	}{
+		{
+			name:   "nothing set keeps the config",
+			env:    map[string]string{},
+			expect: func(config *Config) {},
+		},
+		{
+			name:   "top level string",
+			env:    map[string]string{"IBAN_ISSUER_STORAGE_TYPE": "redis"},
+			expect: func(config *Config) { config.StorageType = "redis" },
+		},
+		{
+			name:   "bool",
+			env:    map[string]string{"IBAN_ISSUER_READINESS_CHECK_IBAN_BACKEND": "true"},
+			expect: func(config *Config) { config.ReadinessCheckIbanBackend = true },
+		},
+		{
+			name:   "int in nested struct",
+			env:    map[string]string{"IBAN_ISSUER_SERVER_CONFIG_PORT": "8443"},
+			expect: func(config *Config) { config.ServerConfig.Port = 8443 },
+		},
+		{
+			name:   "float in nested struct",
+			env:    map[string]string{"IBAN_ISSUER_RATE_LIMIT_CONFIG_PER_IP_RATE": "0.5"},
+			expect: func(config *Config) { config.RateLimitConfig.PerIpRate = 0.5 },
+		},
+		{
+			name:   "named string type",
+			env:    map[string]string{"IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN": "token"},
+			expect: func(config *Config) { config.CmIbanConfig.MerchantToken = "token" },
+		},
+		{
+			name:   "pointer to int set to zero",
+			env:    map[string]string{"IBAN_ISSUER_CM_IBAN_CONFIG_STATUS_RETRIES": "0"},
+			expect: func(config *Config) { config.CmIbanConfig.StatusRetries = &zero },
+		},
+		{
+			name: "slice of strings",
+			env:  map[string]string{"IBAN_ISSUER_RATE_LIMIT_CONFIG_TRUSTED_PROXIES": `["10.0.0.0/8", "192.0.2.1"]`},
+			expect: func(config *Config) {
+				config.RateLimitConfig.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+			},
+		},
+		{
+			name: "slice of structs",
+			env: map[string]string{
+				"IBAN_ISSUER_CREDENTIALS": `[{"credential": "irma-demo.bank.iban", "attributes": {"iban": "iban"}}]`,
+			},
+			expect: func(config *Config) {
+				config.Credentials = []CredentialConfig{{Credential: "irma-demo.bank.iban", Attributes: map[string]string{"iban": "iban"}}}
+			},
+		},
+		{
+			name:   "file variant without trailing newline",
+			env:    map[string]string{"IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN_FILE": tokenPath},
+			expect: func(config *Config) { config.CmIbanConfig.MerchantToken = "token-from-file" },
+		},
+		{
+			name: "both variants set",
+			env: map[string]string{
+				"IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN":      "token",
+				"IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN_FILE": tokenPath,
+			},
+			err: "both IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN and IBAN_ISSUER_CM_IBAN_CONFIG_MERCHANT_TOKEN_FILE are set",
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"IBAN_ISSUER_REDIS_CONFIG_PASSWORD_FILE": filepath.Join(dir, "missing")},
+			err:  "failed to read IBAN_ISSUER_REDIS_CONFIG_PASSWORD_FILE",
+		},
+		{
+			name: "invalid value names the variable",
+			env:  map[string]string{"IBAN_ISSUER_REDIS_CONFIG_PORT": "six"},
+			err:  "invalid value in IBAN_ISSUER_REDIS_CONFIG_PORT",
+		},
+	}
+
+	base := func() Config {
+		return Config{
+			StorageType:  "memory",
+			ServerConfig: ServerConfig{Host: "0.0.0.0", Port: 8080},
+			RedisConfig:  RedisConfig{Host: "localhost", Port: 6379},
+		}
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				value, ok := tc.env[name]
+				return value, ok
+			}
+
+			config := base()
+			err := applyEnvOverrides(&config, lookupEnv)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to apply overrides: %v", err)
+			}
+
+			expected := base()
+			tc.expect(&expected)
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("expected %+v, got %+v", expected, config)
+			}
+		})
+	}
+}
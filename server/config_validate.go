@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"yivi-iban-issuer/bankdir"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Credential ids have the form scheme.issuer.credential
+var credentialIdPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+$`)
+
+// configErrors collects all problems with the config, so they can be reported at once
+type configErrors struct {
+	errs []error
+}
+
+func (c *configErrors) add(format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+func (c *configErrors) required(field string, value string) bool {
+	if value == "" {
+		c.add("%v is required", field)
+		return false
+	}
+	return true
+}
+
+func (c *configErrors) url(field string, value string) {
+	if !c.required(field, value) {
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		c.add("%v should be an absolute url: %v", field, value)
+	}
+}
+
+// returnUrl checks that the url has exactly one %s for the language. Other percent signs
+// are fine, because they're percent-encoded characters that are kept as they are.
+func (c *configErrors) returnUrl(field string, value string) {
+	if !c.required(field, value) {
+		return
+	}
+	if strings.Count(value, "%s") != 1 {
+		c.add("%v should contain exactly one %%s for the language: %v", field, value)
+	} else {
+		c.url(field, formatReturnUrl(value, "en"))
+	}
+}
+
+func (c *configErrors) port(field string, value int) {
+	if value < 1 || value > 65535 {
+		c.add("%v should be between 1 and 65535, got %v", field, value)
+	}
+}
+
+func (c *configErrors) readableFile(field string, path string) bool {
+	if !c.required(field, path) {
+		return false
+	}
+	_, err := os.ReadFile(path)
+	if err != nil {
+		c.add("%v is not readable: %v", field, err)
+		return false
+	}
+	return true
+}
+
+func (c *configErrors) nonNegative(field string, value float64) {
+	if value < 0 {
+		c.add("%v should not be negative, got %v", field, value)
+	}
+}
+
+// Validate checks the whole config and reports every problem it finds at once
+func (config *Config) Validate() error {
+	errs := &configErrors{}
+
+	config.ServerConfig.validate(errs)
+	if err := config.LogConfig.Validate(); err != nil {
+		errs.add("log_config: %v", err)
+	}
+
+	if config.JwtKeySetPath != "" {
+		if _, err := LoadJwtKeySet(config.JwtKeySetPath); err != nil {
+			errs.add("jwt_key_set_path is not a valid key set: %v", err)
+		}
+	} else if errs.readableFile("jwt_private_key_path", config.JwtPrivateKeyPath) {
+		if _, err := LoadSingleJwtKey(config.JwtPrivateKeyPath, config.JwtSigningAlgorithm); err != nil {
+			errs.add("jwt_private_key_path doesn't contain a usable private key: %v", err)
+		}
+	}
+	errs.nonNegative("jwt_key_reload_interval_ms", float64(config.JwtKeyReloadIntervalMs))
+	errs.url("irma_server_url", config.IrmaServerUrl)
+	errs.required("issuer_id", config.IssuerId)
+	if len(config.Credentials) > 0 {
+		for i, credential := range config.Credentials {
+			credential.validate(errs, fmt.Sprintf("credentials[%v]", i))
+		}
+	} else if errs.required("full_credential", config.FullCredential) && !credentialIdPattern.MatchString(config.FullCredential) {
+		errs.add("full_credential should have the form scheme.issuer.credential, got %v", config.FullCredential)
+	}
+
+	switch config.SessionMode {
+	case "", SessionModeClient, SessionModeServer:
+	default:
+		errs.add("session_mode should be %v or %v, got %v", SessionModeClient, SessionModeServer, config.SessionMode)
+	}
+
+	if config.IrmaCallbackUrl != "" {
+		errs.url("irma_callback_url", config.IrmaCallbackUrl)
+		if errs.readableFile("irma_server_public_key_path", config.IrmaServerPublicKeyPath) {
+			keyBytes, _ := os.ReadFile(config.IrmaServerPublicKeyPath)
+			if _, err := jwt.ParseRSAPublicKeyFromPEM(keyBytes); err != nil {
+				errs.add("irma_server_public_key_path doesn't contain a valid RSA public key: %v", err)
+			}
+		}
+	}
+
+	if config.BankDirectoryPath != "" {
+		if _, err := bankdir.Load(config.BankDirectoryPath); err != nil {
+			errs.add("bank_directory_path is not a valid bank directory: %v", err)
+		}
+	}
+
+	switch config.IbanBackend {
+	case "", "cm":
+		config.CmIbanConfig.validate(errs)
+	case "mock":
+		if !config.AllowInsecureMock {
+			errs.add("iban_backend mock issues accounts nobody verified, set allow_insecure_mock to use it")
+		}
+		config.MockIbanConfig.validate(errs)
+	default:
+		errs.add("iban_backend should be cm or mock, got %v", config.IbanBackend)
+	}
+
+	switch config.StorageType {
+	case "memory":
+	case "redis":
+		errs.required("redis_config.host", config.RedisConfig.Host)
+		errs.port("redis_config.port", config.RedisConfig.Port)
+	case "redis_sentinel":
+		errs.required("redis_sentinel_config.sentinel_host", config.RedisSentinelConfig.SentinelHost)
+		errs.port("redis_sentinel_config.sentinel_port", config.RedisSentinelConfig.SentinelPort)
+		errs.required("redis_sentinel_config.master_name", config.RedisSentinelConfig.MasterName)
+	default:
+		errs.add("storage_type should be memory, redis or redis_sentinel, got %v", config.StorageType)
+	}
+	errs.nonNegative("storage_ttl_ms", float64(config.StorageTtlMs))
+	errs.nonNegative("storage_cleanup_interval_ms", float64(config.StorageCleanupIntervalMs))
+	errs.nonNegative("storage_operation_timeout_ms", float64(config.StorageOperationTimeoutMs))
+
+	config.RateLimitConfig.validate(errs)
+
+	return errors.Join(errs.errs...)
+}
+
+func (config *ServerConfig) validate(errs *configErrors) {
+	errs.port("server_config.port", config.Port)
+	if config.UseTls {
+		errs.readableFile("server_config.tls_priv_key_path", config.TlsPrivKeyPath)
+		errs.readableFile("server_config.tls_cert_path", config.TlsCertPath)
+	}
+	errs.nonNegative("server_config.shutdown_delay_ms", float64(config.ShutdownDelayMs))
+	errs.nonNegative("server_config.shutdown_grace_period_ms", float64(config.ShutdownGracePeriodMs))
+}
+
+func (config *CmIbanConfig) validate(errs *configErrors) {
+	errs.url("cm_iban_config.base_url", config.BaseUrl)
+	if config.BaseUrl != "" && !strings.HasPrefix(config.BaseUrl, "https://") {
+		errs.add("cm_iban_config.base_url should use https: %v", config.BaseUrl)
+	}
+	errs.returnUrl("cm_iban_config.return_url", config.ReturnUrl)
+	errs.required("cm_iban_config.merchant_token", string(config.MerchantToken))
+	errs.nonNegative("cm_iban_config.timeout_ms", float64(config.TimeoutMs))
+	errs.nonNegative("cm_iban_config.max_idle_conns", float64(config.MaxIdleConns))
+	if config.StatusRetries != nil {
+		errs.nonNegative("cm_iban_config.status_retries", float64(*config.StatusRetries))
+	}
+	errs.nonNegative("cm_iban_config.retry_backoff_ms", float64(config.RetryBackoffMs))
+	errs.nonNegative("cm_iban_config.circuit_breaker_threshold", float64(config.CircuitBreakerThreshold))
+	errs.nonNegative("cm_iban_config.circuit_breaker_cooldown_ms", float64(config.CircuitBreakerCooldownMs))
+}
+
+func (config *MockIbanConfig) validate(errs *configErrors) {
+	errs.url("mock_iban_config.base_url", config.BaseUrl)
+	errs.returnUrl("mock_iban_config.return_url", config.ReturnUrl)
+	errs.nonNegative("mock_iban_config.expiry_ms", float64(config.ExpiryMs))
+	for i, outcome := range config.Outcomes {
+		if !slices.Contains(mockStatuses, outcome.Status) {
+			errs.add("mock_iban_config.outcomes[%v].status should be one of %v, got %v",
+				i, strings.Join(mockStatuses, ", "), outcome.Status)
+		}
+	}
+}
+
+func (config *RateLimitConfig) validate(errs *configErrors) {
+	errs.nonNegative("rate_limit_config.per_ip_rate", config.PerIpRate)
+	errs.nonNegative("rate_limit_config.per_ip_burst", float64(config.PerIpBurst))
+	errs.nonNegative("rate_limit_config.global_rate", config.GlobalRate)
+	errs.nonNegative("rate_limit_config.global_burst", float64(config.GlobalBurst))
+	if _, err := parseTrustedProxies(config.TrustedProxies); err != nil {
+		errs.add("rate_limit_config.trusted_proxies: %v", err)
+	}
+}
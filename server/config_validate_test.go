@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestReturnUrlValidation(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/%s/return", true},
+		{"https://example.com/%s/return?next=%2Fdone", true},
+		{"https://example.com/return?lang=%s&path=a%20b", true},
+		{"https://example.com/return", false},
+		{"https://example.com/%s/%s/return", false},
+		{"/%s/return", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			errs := &configErrors{}
+			errs.returnUrl("return_url", tc.url)
+			if valid := len(errs.errs) == 0; valid != tc.valid {
+				t.Errorf("expected valid %v, got errors %v", tc.valid, errs.errs)
+			}
+		})
+	}
+}
+
+func TestFormatReturnUrlKeepsPercentEncoding(t *testing.T) {
+	formatted := formatReturnUrl("https://example.com/%s/return?next=%2Fdone", "nl")
+	if formatted != "https://example.com/nl/return?next=%2Fdone" {
+		t.Errorf("unexpected return url %v", formatted)
+	}
+}
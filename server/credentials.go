@@ -0,0 +1,93 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"yivi-iban-issuer/iban"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Values of the verified account that can be issued in an attribute
+const (
+	AttributeSourceName             = "name"
+	AttributeSourceIban             = "iban"
+	AttributeSourceMaskedIban       = "masked_iban"
+	AttributeSourceCountryCode      = "country_code"
+	AttributeSourceBic              = "bic"
+	AttributeSourceBankName         = "bank_name"
+	AttributeSourceIdealIssuerId    = "ideal_issuer_id"
+	AttributeSourceVerificationDate = "verification_date"
+)
+
+var attributeSources = map[string]func(account IbanAccount) string{
+	AttributeSourceName:             func(account IbanAccount) string { return account.Fullname },
+	AttributeSourceIban:             func(account IbanAccount) string { return account.Iban },
+	AttributeSourceMaskedIban:       func(account IbanAccount) string { return iban.Mask(account.Iban) },
+	AttributeSourceCountryCode:      func(account IbanAccount) string { return iban.CountryCode(account.Iban) },
+	AttributeSourceBic:              func(account IbanAccount) string { return account.Bic },
+	AttributeSourceBankName:         func(account IbanAccount) string { return account.BankName },
+	AttributeSourceIdealIssuerId:    func(account IbanAccount) string { return account.IdealIssuerId },
+	AttributeSourceVerificationDate: func(account IbanAccount) string { return account.VerifiedAt.UTC().Format(time.DateOnly) },
+}
+
+// CredentialConfig describes one of the credentials that is issued for a verified account
+type CredentialConfig struct {
+	Credential string `json:"credential"`
+	// Maps the attributes of the credential to the value of the account they're filled with
+	Attributes map[string]string `json:"attributes"`
+}
+
+// defaultCredentials is the single credential that is issued when no credentials are configured
+func defaultCredentials(credential string, bankNameAttribute string) []CredentialConfig {
+	attributes := map[string]string{
+		"fullname": AttributeSourceName,
+		"iban":     AttributeSourceIban,
+		"bic":      AttributeSourceBic,
+	}
+	if bankNameAttribute != "" {
+		attributes[bankNameAttribute] = AttributeSourceBankName
+	}
+	return []CredentialConfig{{Credential: credential, Attributes: attributes}}
+}
+
+func (c *CredentialConfig) validate(errs *configErrors, field string) {
+	if errs.required(field+".credential", c.Credential) && !credentialIdPattern.MatchString(c.Credential) {
+		errs.add("%v.credential should have the form scheme.issuer.credential, got %v", field, c.Credential)
+	}
+	if len(c.Attributes) == 0 {
+		errs.add("%v.attributes should map at least one attribute", field)
+	}
+	for attribute, source := range c.Attributes {
+		if _, ok := attributeSources[source]; !ok {
+			errs.add("%v.attributes.%v has unknown source %v, should be one of %v",
+				field, attribute, source, strings.Join(slices.Sorted(maps.Keys(attributeSources)), ", "))
+		}
+	}
+}
+
+// NewIbanIssuanceRequest creates the issuance request with all configured credentials for the verified account
+func NewIbanIssuanceRequest(credentials []CredentialConfig, account IbanAccount) *irma.IssuanceRequest {
+	credentialRequests := make([]*irma.CredentialRequest, 0, len(credentials))
+	for _, credential := range credentials {
+		attributes := make(map[string]string, len(credential.Attributes))
+		for attribute, source := range credential.Attributes {
+			attributes[attribute] = attributeSources[source](account)
+		}
+		credentialRequests = append(credentialRequests, &irma.CredentialRequest{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier(credential.Credential),
+			Attributes:       attributes,
+		})
+	}
+	return irma.NewIssuanceRequest(credentialRequests)
+}
+
+// credentialConfigs returns the configured credentials, or the default credential from full_credential
+func (config *Config) credentialConfigs() []CredentialConfig {
+	if len(config.Credentials) > 0 {
+		return config.Credentials
+	}
+	return defaultCredentials(config.FullCredential, config.BankNameAttribute)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssuanceRequestWithMultipleCredentials(t *testing.T) {
+	credentials := []CredentialConfig{
+		{
+			Credential: "pbdf.pbdf.iban",
+			Attributes: map[string]string{
+				"fullname": AttributeSourceName,
+				"iban":     AttributeSourceIban,
+				"bic":      AttributeSourceBic,
+				"bankname": AttributeSourceBankName,
+			},
+		},
+		{
+			Credential: "pbdf.pbdf.bankaccount",
+			Attributes: map[string]string{
+				"masked":   AttributeSourceMaskedIban,
+				"country":  AttributeSourceCountryCode,
+				"issuer":   AttributeSourceIdealIssuerId,
+				"verified": AttributeSourceVerificationDate,
+			},
+		},
+	}
+	account := IbanAccount{
+		Fullname:      "J. Doe",
+		Iban:          "NL91ABNA0417164300",
+		Bic:           "ABNANL2A",
+		BankName:      "ABN AMRO",
+		IdealIssuerId: "ABNANL2A",
+		// Just after midnight in Amsterdam, which is still the previous day in UTC
+		VerifiedAt: time.Date(2026, 3, 15, 0, 30, 0, 0, time.FixedZone("CET", 3600)),
+	}
+
+	request := NewIbanIssuanceRequest(credentials, account)
+
+	if len(request.Credentials) != 2 {
+		t.Fatalf("expected 2 credentials, got %v", len(request.Credentials))
+	}
+	expected := []struct {
+		credential string
+		attributes map[string]string
+	}{
+		{"pbdf.pbdf.iban", map[string]string{
+			"fullname": "J. Doe",
+			"iban":     "NL91ABNA0417164300",
+			"bic":      "ABNANL2A",
+			"bankname": "ABN AMRO",
+		}},
+		{"pbdf.pbdf.bankaccount", map[string]string{
+			"masked":   "NL91**********4300",
+			"country":  "NL",
+			"issuer":   "ABNANL2A",
+			"verified": "2026-03-14",
+		}},
+	}
+	for i, credential := range request.Credentials {
+		if credential.CredentialTypeID.String() != expected[i].credential {
+			t.Errorf("credential %v should be %v, got %v", i, expected[i].credential, credential.CredentialTypeID)
+		}
+		if !reflect.DeepEqual(credential.Attributes, expected[i].attributes) {
+			t.Errorf("credential %v should have attributes %v, got %v", i, expected[i].attributes, credential.Attributes)
+		}
+	}
+}
+
+func TestDefaultCredentialAddsBankNameWhenConfigured(t *testing.T) {
+	config := &Config{FullCredential: "pbdf.pbdf.iban", BankNameAttribute: "bankname"}
+
+	credentials := config.credentialConfigs()
+	if len(credentials) != 1 || credentials[0].Credential != "pbdf.pbdf.iban" {
+		t.Fatalf("expected only the full credential, got %+v", credentials)
+	}
+	expected := map[string]string{
+		"fullname": AttributeSourceName,
+		"iban":     AttributeSourceIban,
+		"bic":      AttributeSourceBic,
+		"bankname": AttributeSourceBankName,
+	}
+	if !reflect.DeepEqual(credentials[0].Attributes, expected) {
+		t.Errorf("expected attributes %v, got %v", expected, credentials[0].Attributes)
+	}
+}
+
+func TestCredentialConfigValidation(t *testing.T) {
+	errs := &configErrors{}
+	credential := CredentialConfig{Credential: "pbdf.iban", Attributes: map[string]string{"iban": "account_number"}}
+	credential.validate(errs, "credentials[0]")
+
+	if len(errs.errs) != 2 {
+		t.Errorf("expected an invalid id and an unknown source, got %v", errs.errs)
+	}
+}
+
+func TestAccountAndStatusLeaveOutNameAndIbanWhenLogged(t *testing.T) {
+	values := map[string]slog.LogValuer{
+		"account": IbanAccount{Fullname: "J. Doe", Iban: "NL91ABNA0417164300", Bic: "ABNANL2A"},
+		"status":  TransactionStatus{TransactionID: "trx", Status: "success", Name: "J. Doe", IBAN: "NL91ABNA0417164300"},
+	}
+	for name, value := range values {
+		logged := value.LogValue().String()
+		if strings.Contains(logged, "J. Doe") || strings.Contains(logged, "NL91ABNA0417164300") {
+			t.Errorf("logged %v should not contain the name or iban, got %v", name, logged)
+		}
+	}
+}
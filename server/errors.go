@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes that are returned to the frontend in the error field of an ErrorResponseMessage
+const (
+	ErrorInternal                = "error:internal"
+	ErrorRateLimit               = "error:ratelimit"
+	ErrorMethodNotAllowed        = "error:method-not-allowed"
+	ErrorMalformedRequest        = "error:malformed-request"
+	ErrorInvalidLanguage         = "error:invalid-language"
+	ErrorTransactionNotFound     = "error:transaction-not-found"
+	ErrorIbanProviderUnavailable = "error:iban-provider-unavailable"
+	ErrorStorageUnavailable      = "error:storage-unavailable"
+	ErrorJwtSigning              = "error:jwt-signing"
+	ErrorIrmaSession             = "error:irma-session"
+	ErrorAlreadyIssued           = "error:already-issued"
+	ErrorInvalidSessionResult    = "error:invalid-session-result"
+	ErrorSessionMismatch         = "error:session-mismatch"
+	ErrorInvalidIban             = "error:invalid-iban"
+	ErrorUnknownBank             = "error:unknown-bank"
+)
+
+// ErrTokenNotFound is returned by a TokenStorage when there is no entry for a transaction
+var ErrTokenNotFound = errors.New("token not found")
+
+// ErrAlreadyClaimed is returned by a TokenStorage when a transaction was already claimed for issuance
+var ErrAlreadyClaimed = errors.New("transaction already claimed for issuance")
+
+// IbanCheckerError is returned by an IbanChecker when the iDEAL provider couldn't be used
+type IbanCheckerError struct {
+	Op  string
+	Err error
+}
+
+func (e *IbanCheckerError) Error() string {
+	return fmt.Sprintf("iban checker %v: %v", e.Op, e.Err)
+}
+
+func (e *IbanCheckerError) Unwrap() error {
+	return e.Err
+}
+
+// TokenStorageError is returned by a TokenStorage when the storage backend failed
+type TokenStorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *TokenStorageError) Error() string {
+	return fmt.Sprintf("token storage %v: %v", e.Op, e.Err)
+}
+
+func (e *TokenStorageError) Unwrap() error {
+	return e.Err
+}
+
+// errorResponse maps an error from one of the backends to a status code
+// and the error code that is returned to the client
+func errorResponse(err error) (int, string) {
+	var ibanErr *IbanCheckerError
+	var storageErr *TokenStorageError
+
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		return http.StatusNotFound, ErrorTransactionNotFound
+	case errors.Is(err, ErrAlreadyClaimed):
+		return http.StatusConflict, ErrorAlreadyIssued
+	case errors.As(err, &ibanErr):
+		return http.StatusBadGateway, ErrorIbanProviderUnavailable
+	case errors.As(err, &storageErr):
+		return http.StatusServiceUnavailable, ErrorStorageUnavailable
+	default:
+		return http.StatusInternalServerError, ErrorInternal
+	}
+}
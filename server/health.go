@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	log "yivi-iban-issuer/logging"
+)
+
+// Time a single readiness check may take
+const readinessCheckTimeout = 2 * time.Second
+
+// CheckResult only tells whether the check passed, the error is logged
+// because it can contain details like addresses of the dependencies
+type CheckResult struct {
+	Ok bool `json:"ok"`
+}
+
+type ReadinessReport struct {
+	Ok     bool                   `json:"ok"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// ReachabilityChecker is implemented by IbanCheckers that can check whether their provider can be reached
+type ReachabilityChecker interface {
+	CheckReachable(ctx context.Context) error
+}
+
+// checkReadiness runs all dependency checks and reports the result of each of them
+func checkReadiness(ctx context.Context, state *ServerState) ReadinessReport {
+	checks := map[string]func(ctx context.Context) error{
+		"shutdown": func(ctx context.Context) error {
+			if state.shuttingDown.Load() {
+				return errors.New("server is shutting down")
+			}
+			return nil
+		},
+		"token_storage": state.tokenStorage.Ping,
+		"jwt_signing": func(ctx context.Context) error {
+			return state.jwtCreator.Probe()
+		},
+	}
+	if reachability, ok := state.ibanChecker.(ReachabilityChecker); ok && state.checkIbanBackend {
+		checks["iban_backend"] = reachability.CheckReachable
+	}
+
+	report := ReadinessReport{Ok: true, Checks: make(map[string]CheckResult)}
+	for name, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		err := check(checkCtx)
+		cancel()
+		if err != nil {
+			log.Error(ctx, "readiness check failed", "check", name, "error", err)
+			report.Ok = false
+			report.Checks[name] = CheckResult{Ok: false}
+		} else {
+			report.Checks[name] = CheckResult{Ok: true}
+		}
+	}
+	return report
+}
+
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	if err != nil {
+		log.Error(r.Context(), "failed to write body to http response", "error", err)
+	}
+}
+
+func handleReadiness(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	report := checkReadiness(r.Context(), state)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Error(r.Context(), "failed to write body to http response", "error", err)
+	}
+}
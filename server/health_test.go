@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getReadiness(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url + "/api/health/ready")
+	if err != nil {
+		t.Fatalf("readiness request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read readiness report: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestReadinessHidesErrorDetails(t *testing.T) {
+	server := newTestServer(t, &ServerState{
+		ibanChecker:  &stubIbanChecker{},
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: failingTokenStorage{newTestTokenStorage(t)},
+	})
+
+	status, body := getReadiness(t, server.URL)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %v", status)
+	}
+	if strings.Contains(body, errStorageDown.Error()) {
+		t.Errorf("readiness report shouldn't contain the error, got %v", body)
+	}
+
+	var report ReadinessReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("failed to decode readiness report: %v", err)
+	}
+	if report.Ok || report.Checks["token_storage"].Ok || !report.Checks["jwt_signing"].Ok {
+		t.Errorf("only the token storage check should fail, got %+v", report)
+	}
+}
+
+func TestReadinessIsServedOnMetricsListener(t *testing.T) {
+	server, err := NewServer(&ServerState{
+		ibanChecker:  &stubIbanChecker{},
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: newTestTokenStorage(t),
+	}, ServerConfig{StaticPath: t.TempDir(), MetricsAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	public := httptest.NewServer(server.server.Handler)
+	t.Cleanup(public.Close)
+	metrics := httptest.NewServer(server.metricsServer.Handler)
+	t.Cleanup(metrics.Close)
+
+	if status, body := getReadiness(t, metrics.URL); status != http.StatusOK {
+		t.Errorf("readiness should be served on the metrics listener, got %v: %v", status, body)
+	}
+	if _, body := getReadiness(t, public.URL); strings.Contains(body, "checks") {
+		t.Errorf("readiness shouldn't be served on the public listener, got %v", body)
+	}
+}
@@ -0,0 +1,107 @@
+package iban
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidCharacters = errors.New("iban contains invalid characters")
+	ErrUnknownCountry    = errors.New("iban has an unknown country code")
+	ErrInvalidLength     = errors.New("iban has an invalid length for its country")
+	ErrInvalidChecksum   = errors.New("iban has an invalid checksum")
+)
+
+// Lengths of the IBANs per country, as registered in the ISO 13616 IBAN registry
+var countryLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AX": 18, "AZ": 28, "BA": 20, "BE": 16,
+	"BG": 22, "BH": 22, "BI": 27, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28,
+	"CZ": 24, "DE": 22, "DJ": 27, "DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24,
+	"FI": 18, "FK": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18,
+	"GR": 27, "GT": 28, "HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26,
+	"IT": 27, "JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LC": 32, "LI": 21, "LT": 20,
+	"LU": 20, "LV": 21, "LY": 25, "MC": 27, "MD": 24, "ME": 22, "MK": 19, "MN": 20,
+	"MR": 27, "MT": 31, "MU": 30, "NI": 28, "NL": 18, "NO": 15, "OM": 23, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "RU": 33, "SA": 24,
+	"SC": 31, "SD": 18, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "SO": 23, "ST": 25,
+	"SV": 28, "TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+	"YE": 30,
+}
+
+// Normalize removes the spacing from the IBAN and converts it to upper case
+func Normalize(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// Validate normalizes the IBAN and checks its characters, the length for its
+// country and the mod-97 checksum. Returns the normalized IBAN when it's valid.
+func Validate(iban string) (string, error) {
+	normalized := Normalize(iban)
+
+	for _, c := range normalized {
+		if !isDigit(c) && !isUpper(c) {
+			return "", ErrInvalidCharacters
+		}
+	}
+
+	if len(normalized) < 4 || !isUpper(rune(normalized[0])) || !isUpper(rune(normalized[1])) ||
+		!isDigit(rune(normalized[2])) || !isDigit(rune(normalized[3])) {
+		return "", ErrInvalidCharacters
+	}
+
+	country := normalized[:2]
+	length, ok := countryLengths[country]
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrUnknownCountry, country)
+	}
+	if len(normalized) != length {
+		return "", fmt.Errorf("%w: %v should have %v characters, got %v", ErrInvalidLength, country, length, len(normalized))
+	}
+
+	if checksum(normalized) != 1 {
+		return "", ErrInvalidChecksum
+	}
+
+	return normalized, nil
+}
+
+// CountryCode returns the country code of a normalized IBAN
+func CountryCode(iban string) string {
+	if len(iban) < 2 {
+		return ""
+	}
+	return iban[:2]
+}
+
+// Mask hides all but the country code, check digits and last four characters of a normalized IBAN
+func Mask(iban string) string {
+	if len(iban) <= 8 {
+		return iban
+	}
+	return iban[:4] + strings.Repeat("*", len(iban)-8) + iban[len(iban)-4:]
+}
+
+// checksum computes the ISO 7064 mod-97 remainder of the IBAN, with the first four
+// characters moved to the end and the letters replaced by 10 to 35
+func checksum(iban string) int {
+	rearranged := iban[4:] + iban[:4]
+
+	remainder := 0
+	for _, c := range rearranged {
+		if isDigit(c) {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		} else {
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		}
+	}
+	return remainder
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isUpper(c rune) bool {
+	return c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,113 @@
+package iban
+
+import (
+	"errors"
+	"testing"
+)
+
+// An example IBAN from the IBAN registry for every SEPA country, and the same IBAN with wrong check digits
+var sepaIbans = []struct {
+	country string
+	valid   string
+	invalid string
+}{
+	{"AD", "AD1200012030200359100100", "AD1300012030200359100100"},
+	{"AT", "AT611904300234573201", "AT621904300234573201"},
+	{"BE", "BE68539007547034", "BE69539007547034"},
+	{"BG", "BG80BNBG96611020345678", "BG81BNBG96611020345678"},
+	{"CH", "CH9300762011623852957", "CH9400762011623852957"},
+	{"CY", "CY17002001280000001200527600", "CY18002001280000001200527600"},
+	{"CZ", "CZ6508000000192000145399", "CZ6608000000192000145399"},
+	{"DE", "DE89370400440532013000", "DE90370400440532013000"},
+	{"DK", "DK5000400440116243", "DK5100400440116243"},
+	{"EE", "EE382200221020145685", "EE392200221020145685"},
+	{"ES", "ES9121000418450200051332", "ES9221000418450200051332"},
+	{"FI", "FI2112345600000785", "FI2212345600000785"},
+	{"FR", "FR1420041010050500013M02606", "FR1520041010050500013M02606"},
+	{"GB", "GB29NWBK60161331926819", "GB30NWBK60161331926819"},
+	{"GI", "GI75NWBK000000007099453", "GI76NWBK000000007099453"},
+	{"GR", "GR1601101250000000012300695", "GR1701101250000000012300695"},
+	{"HR", "HR1210010051863000160", "HR1310010051863000160"},
+	{"HU", "HU42117730161111101800000000", "HU43117730161111101800000000"},
+	{"IE", "IE29AIBK93115212345678", "IE30AIBK93115212345678"},
+	{"IS", "IS140159260076545510730339", "IS150159260076545510730339"},
+	{"IT", "IT60X0542811101000000123456", "IT61X0542811101000000123456"},
+	{"LI", "LI21088100002324013AA", "LI22088100002324013AA"},
+	{"LT", "LT121000011101001000", "LT131000011101001000"},
+	{"LU", "LU280019400644750000", "LU290019400644750000"},
+	{"LV", "LV80BANK0000435195001", "LV81BANK0000435195001"},
+	{"MC", "MC5811222000010123456789030", "MC5911222000010123456789030"},
+	{"MT", "MT84MALT011000012345MTLCAST001S", "MT85MALT011000012345MTLCAST001S"},
+	{"NL", "NL91ABNA0417164300", "NL92ABNA0417164300"},
+	{"NO", "NO9386011117947", "NO9486011117947"},
+	{"PL", "PL61109010140000071219812874", "PL62109010140000071219812874"},
+	{"PT", "PT50000201231234567890154", "PT51000201231234567890154"},
+	{"RO", "RO49AAAA1B31007593840000", "RO50AAAA1B31007593840000"},
+	{"SE", "SE4550000000058398257466", "SE4650000000058398257466"},
+	{"SI", "SI56263300012039086", "SI57263300012039086"},
+	{"SK", "SK3112000000198742637541", "SK3212000000198742637541"},
+	{"SM", "SM86U0322509800000000270100", "SM87U0322509800000000270100"},
+	{"VA", "VA59001123000012345678", "VA60001123000012345678"},
+}
+
+func TestValidateSepaCountries(t *testing.T) {
+	for _, tc := range sepaIbans {
+		t.Run(tc.country, func(t *testing.T) {
+			normalized, err := Validate(tc.valid)
+			if err != nil {
+				t.Errorf("%v should be valid: %v", tc.valid, err)
+			}
+			if normalized != tc.valid {
+				t.Errorf("expected %v, got %v", tc.valid, normalized)
+			}
+			if len(tc.valid) != countryLengths[tc.country] {
+				t.Errorf("example doesn't have the registered length of %v", tc.country)
+			}
+
+			_, err = Validate(tc.invalid)
+			if !errors.Is(err, ErrInvalidChecksum) {
+				t.Errorf("%v should have an invalid checksum, got %v", tc.invalid, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		normalized string
+		err        error
+	}{
+		{"spacing", "NL91 ABNA 0417 1643 00", "NL91ABNA0417164300", nil},
+		{"surrounding whitespace", "  NL91ABNA0417164300\n", "NL91ABNA0417164300", nil},
+		{"lowercase", "nl91abna0417164300", "NL91ABNA0417164300", nil},
+		{"lowercase with spacing", "de89 3704 0044 0532 0130 00", "DE89370400440532013000", nil},
+		{"bad checksum", "NL91ABNA0417164301", "", ErrInvalidChecksum},
+		{"swapped digits", "NL91ABNA0417163400", "", ErrInvalidChecksum},
+		{"too short", "NL91ABNA041716430", "", ErrInvalidLength},
+		{"too long", "NL91ABNA04171643000", "", ErrInvalidLength},
+		{"unknown country", "XX91ABNA0417164300", "", ErrUnknownCountry},
+		{"invalid characters", "NL91-ABNA-0417-1643-00", "", ErrInvalidCharacters},
+		{"no check digits", "NLAB", "", ErrInvalidCharacters},
+		{"empty", "", "", ErrInvalidCharacters},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			normalized, err := Validate(tc.input)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			if normalized != tc.normalized {
+				t.Errorf("expected %q, got %q", tc.normalized, normalized)
+			}
+		})
+	}
+}
+
+func TestMask(t *testing.T) {
+	if masked := Mask("NL91ABNA0417164300"); masked != "NL91**********4300" {
+		t.Errorf("unexpected mask %v", masked)
+	}
+}
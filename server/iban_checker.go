@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"strings"
-	"time"
 	log "yivi-iban-issuer/logging"
 )
 
@@ -43,9 +42,18 @@ type TransactionStatus struct {
 	IBAN          string       `json:"iban"`
 }
 
+// LogValue leaves out the name and IBAN of the account holder when the status is logged
+func (s TransactionStatus) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("transaction_id", string(s.TransactionID)),
+		slog.String("status", s.Status),
+		slog.String("issuer_id", s.IssuerID),
+	)
+}
+
 type IbanChecker interface {
-	GetStatus(merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error)
-	StartIbanCheck(entranceCode string, language string) (*IdealTransaction, error)
+	GetStatus(ctx context.Context, merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error)
+	StartIbanCheck(ctx context.Context, entranceCode string, language string) (*IdealTransaction, error)
 }
 
 type CmIbanConfig struct {
@@ -53,10 +61,28 @@ type CmIbanConfig struct {
 	TimeoutMs     int64         `json:"timeout_ms"`
 	ReturnUrl     string        `json:"return_url"`
 	MerchantToken MerchantToken `json:"merchant_token"`
+
+	// Idle connections kept open to CM, 10 by default
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Retries of a failed status poll, 2 by default
+	StatusRetries *int `json:"status_retries,omitempty"`
+	// Backoff before the first retry, doubled for every next one, 200ms by default
+	RetryBackoffMs int64 `json:"retry_backoff_ms,omitempty"`
+	// Consecutive failures after which calls to CM fail fast, 5 by default
+	CircuitBreakerThreshold int `json:"circuit_breaker_threshold,omitempty"`
+	// Time before CM is tried again after the circuit breaker opened, 30 seconds by default
+	CircuitBreakerCooldownMs int64 `json:"circuit_breaker_cooldown_ms,omitempty"`
+}
+
+// formatReturnUrl puts the language in the place of the %s in the return url. The url isn't
+// used as a format string, so percent-encoded characters in it are kept as they are.
+func formatReturnUrl(returnUrl string, language string) string {
+	return strings.Replace(returnUrl, "%s", language, 1)
 }
 
 type CmIbanChecker struct {
 	CmIbanConfig
+	client *cmClient
 }
 
 func NewCmIbanChecker(config CmIbanConfig) (*CmIbanChecker, error) {
@@ -64,43 +90,55 @@ func NewCmIbanChecker(config CmIbanConfig) (*CmIbanChecker, error) {
 		return nil, errors.New("CM gateway API endpoint should use https: " + config.BaseUrl)
 	}
 
-	return &CmIbanChecker{config}, nil
+	return &CmIbanChecker{config, newCmClient(config)}, nil
+}
+
+// CheckReachable checks whether CM can be reached, any http response counts
+func (s *CmIbanChecker) CheckReachable(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.BaseUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
 
-func (s *CmIbanChecker) GetStatus(merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error) {
+func (s *CmIbanChecker) GetStatus(ctx context.Context, merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error) {
 	merchantTransaction := MerchantTransaction{
 		MerchantToken:     s.MerchantToken,
 		TransactionID:     transactionId,
 		MerchantReference: merchantRef,
 	}
 
-	log.Info.Printf("Checking status for transaction: %v", transactionId)
+	log.Info(ctx, "Checking status", "transaction_id", transactionId)
 
 	jsonData, err := json.Marshal(merchantTransaction)
 	if err != nil {
-		log.Error.Fatal("Error marshaling JSON:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "status", Err: fmt.Errorf("failed to marshal request: %w", err)}
 	}
 
-	bytes, err := CallCM(s, "POST", s.BaseUrl+"status", bytes.NewBuffer(jsonData))
+	// Polling the status is idempotent, so it's safe to retry
+	bytes, err := s.client.call(ctx, "POST", "status", jsonData, true)
 	if err != nil {
-		log.Error.Fatal("Error calling CM:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "status", Err: err}
 	}
 
 	var transactionStatus TransactionStatus
 	err = json.Unmarshal(bytes, &transactionStatus)
 	if err != nil {
-		log.Error.Fatal("Error unmarshaling response:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "status", Err: fmt.Errorf("failed to unmarshal response: %w", err)}
 	}
 
 	return &transactionStatus, nil
 }
 
-func (s *CmIbanChecker) StartIbanCheck(entranceCode string, language string) (*IdealTransaction, error) {
-	returnUrl := fmt.Sprintf(s.ReturnUrl, language)
-	log.Info.Printf("Starting IBAN check, composed returnUrl is: %v", returnUrl)
+func (s *CmIbanChecker) StartIbanCheck(ctx context.Context, entranceCode string, language string) (*IdealTransaction, error) {
+	returnUrl := formatReturnUrl(s.ReturnUrl, language)
+	log.Info(ctx, "Starting IBAN check", "return_url", returnUrl)
 
 	ibanCheck := IbanCheck{
 		MerchantToken:     s.MerchantToken,
@@ -110,56 +148,21 @@ func (s *CmIbanChecker) StartIbanCheck(entranceCode string, language string) (*I
 
 	jsonData, err := json.Marshal(ibanCheck)
 	if err != nil {
-		log.Error.Fatal("Error marshaling JSON:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "transaction", Err: fmt.Errorf("failed to marshal request: %w", err)}
 	}
 
 	// Do a request to CM backend.
-	log.Info.Printf("Calling CM with URL: %v", s.BaseUrl+"transaction")
-	bytes, err := CallCM(s, "POST", s.BaseUrl+"transaction", bytes.NewBuffer(jsonData))
+	log.Debug(ctx, "Calling CM", "url", s.BaseUrl+"transaction")
+	bytes, err := s.client.call(ctx, "POST", "transaction", jsonData, false)
 	if err != nil {
-		log.Error.Fatal("Error calling CM:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "transaction", Err: err}
 	}
 
 	var ibanTransaction IdealTransaction
 	err = json.Unmarshal(bytes, &ibanTransaction)
 	if err != nil {
-		log.Error.Fatal("Error unmarshaling response:", err)
-		return nil, err
+		return nil, &IbanCheckerError{Op: "transaction", Err: fmt.Errorf("failed to unmarshal response: %w", err)}
 	}
 
 	return &ibanTransaction, nil
 }
-
-func CallCM(s *CmIbanChecker, method string, url string, body io.Reader) ([]byte, error) {
-	// Create the request
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		log.Error.Fatal("Error creating request:", err)
-		return nil, err
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-
-	// Create the HTTP client and execute the request
-	client := &http.Client{Timeout: time.Duration(s.TimeoutMs) * time.Millisecond}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error.Fatal("Error making request:", err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Error.Fatal("Error reading response:", err)
-		return nil, err
-	}
-
-	// Print status and response
-	log.Info.Printf("CM Responsed with status code %v", resp.Status)
-	return bytes, nil
-}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	log "yivi-iban-issuer/logging"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	irma "github.com/privacybydesign/irmago"
+	irmaserver "github.com/privacybydesign/irmago/server"
+)
+
+const IrmaCallbackPath = "/api/irma-callback/"
+
+// Issuance results are small, anything bigger isn't read
+const maxIrmaCallbackSize = 64 * 1024
+
+// the IRMA server sets the subject of a result JWT to "<session type>_result"
+const issuanceResultSubject = string(irma.ActionIssuing) + "_result"
+
+var errSessionResultMismatch = errors.New("session result doesn't belong to the session of the transaction")
+
+// IrmaResultVerifier verifies the session results the IRMA server posts to the callback url.
+// The IRMA server signs these results when it's configured with a JWT private key.
+type IrmaResultVerifier struct {
+	publicKey *rsa.PublicKey
+}
+
+func NewIrmaResultVerifier(publicKeyPath string) (*IrmaResultVerifier, error) {
+	keyBytes, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IrmaResultVerifier{publicKey: publicKey}, nil
+}
+
+type issuanceResultClaims struct {
+	jwt.RegisteredClaims
+	irmaserver.SessionResult
+}
+
+func (v *IrmaResultVerifier) Verify(resultJwt string) (*irmaserver.SessionResult, error) {
+	var claims issuanceResultClaims
+	_, err := jwt.ParseWithClaims(resultJwt, &claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return v.publicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Subject != issuanceResultSubject || claims.Type != irma.ActionIssuing {
+		return nil, fmt.Errorf("session result is not an issuance result: %v", claims.Subject)
+	}
+	if !claims.Status.Finished() {
+		return nil, fmt.Errorf("session result has unfinished status %v", claims.Status)
+	}
+
+	return &claims.SessionResult, nil
+}
+
+// handles the POST request of the IRMA server with the result of an issuance session
+// for the transaction in the url. The callback secret in the url proves the result
+// belongs to the latest issuance session of the transaction.
+func handleIrmaCallback(state *ServerState, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != "POST" {
+		respondWithErr(w, r, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "method not allowed", fmt.Errorf("got %v", r.Method))
+		return
+	}
+
+	transactionId := TransactonId(mux.Vars(r)["transaction_id"])
+	callbackHash := hashNonce(mux.Vars(r)["secret"])
+	r = r.WithContext(log.WithAttrs(r.Context(), "transaction_id", transactionId))
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIrmaCallbackSize))
+	if err != nil {
+		respondWithErr(w, r, http.StatusBadRequest, ErrorMalformedRequest, "failed to read body of the request", err)
+		return
+	}
+
+	result, err := state.resultVerifier.Verify(string(body))
+	if err != nil {
+		respondWithErr(w, r, http.StatusUnauthorized, ErrorInvalidSessionResult, "failed to verify session result", err)
+		return
+	}
+
+	// Only a successful issuance uses up the transaction, otherwise the
+	// claim is released so the issuance can be retried
+	_, err = state.tokenStorage.UpdateTransaction(r.Context(), transactionId, func(record *TransactionRecord) error {
+		// Any result signed by the IRMA server is valid, so it has to belong to the session of this transaction
+		if subtle.ConstantTimeCompare([]byte(callbackHash), []byte(record.IrmaCallbackHash)) != 1 {
+			return errSessionResultMismatch
+		}
+		if record.IrmaSessionToken != "" && record.IrmaSessionToken != result.Token {
+			return errSessionResultMismatch
+		}
+		record.IssuanceResult = result.Status
+		if result.Status != irma.ServerStatusDone {
+			record.JwtIssued = false
+			record.State = TransactionVerified
+		}
+		return nil
+	})
+	if errors.Is(err, errSessionResultMismatch) {
+		respondWithErr(w, r, http.StatusUnauthorized, ErrorInvalidSessionResult, "session result belongs to another session", err)
+		return
+	}
+	if err != nil {
+		respondWithBackendErr(w, r, "failed to store issuance result", err)
+		return
+	}
+
+	issuanceResults.WithLabelValues(string(result.Status)).Inc()
+	log.Info(r.Context(), "Issuance session finished", "status", result.Status)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	irmaserver "github.com/privacybydesign/irmago/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func signSessionResult(t *testing.T, key *rsa.PrivateKey, token irma.RequestorToken, status irma.ServerStatus) string {
+	t.Helper()
+	claims := issuanceResultClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: issuanceResultSubject},
+		SessionResult: irmaserver.SessionResult{
+			Token:  token,
+			Status: status,
+			Type:   irma.ActionIssuing,
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign session result: %v", err)
+	}
+	return signed
+}
+
+// newCallbackTestServer stores the record with a callback secret and returns the callback url of the record
+func newCallbackTestServer(t *testing.T, record *TransactionRecord) (*rsa.PrivateKey, *InMemoryTokenStorage, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	secret, hash, err := newNonce()
+	if err != nil {
+		t.Fatalf("failed to create callback secret: %v", err)
+	}
+	record.IrmaCallbackHash = hash
+	storage := newTestTokenStorage(t)
+	if err := storage.StoreTransaction(context.Background(), record); err != nil {
+		t.Fatalf("failed to store transaction: %v", err)
+	}
+	server := newTestServer(t, &ServerState{
+		ibanChecker:    &stubIbanChecker{},
+		jwtCreator:     stubJwtCreator{},
+		tokenStorage:   storage,
+		resultVerifier: &IrmaResultVerifier{publicKey: &key.PublicKey},
+	})
+	return key, storage, server.URL + IrmaCallbackPath + string(record.TransactionID) + "/" + secret
+}
+
+func TestIrmaCallbackRejectsResultOfOtherSession(t *testing.T) {
+	key, storage, url := newCallbackTestServer(t, &TransactionRecord{
+		TransactionID:    "trx",
+		State:            TransactionJwtIssued,
+		JwtIssued:        true,
+		IrmaSessionToken: "session-of-trx",
+	})
+
+	resp := postJson(t, url, signSessionResult(t, key, "other-session", irma.ServerStatusCancelled))
+	assertErrorResponse(t, resp, http.StatusUnauthorized, ErrorInvalidSessionResult)
+
+	record, _ := storage.RetrieveTransaction(context.Background(), "trx")
+	if !record.JwtIssued || record.IssuanceResult != "" {
+		t.Errorf("result of another session shouldn't change the transaction, got %+v", record)
+	}
+}
+
+func TestIrmaCallbackRejectsWrongSecret(t *testing.T) {
+	// In client mode the session token isn't known, so only the secret ties the result to the transaction
+	key, storage, url := newCallbackTestServer(t, &TransactionRecord{
+		TransactionID: "trx",
+		State:         TransactionJwtIssued,
+		JwtIssued:     true,
+	})
+	wrongUrl := url[:strings.LastIndex(url, "/")+1] + "guessed-secret"
+
+	for _, target := range []string{wrongUrl, strings.TrimSuffix(wrongUrl, "guessed-secret")} {
+		resp := postJson(t, target, signSessionResult(t, key, "some-session", irma.ServerStatusCancelled))
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("result posted to %v should be rejected", target)
+		}
+	}
+
+	record, _ := storage.RetrieveTransaction(context.Background(), "trx")
+	if !record.JwtIssued || record.IssuanceResult != "" {
+		t.Errorf("result with a wrong secret shouldn't change the transaction, got %+v", record)
+	}
+}
+
+func TestIrmaCallbackStoresResultOfOwnSession(t *testing.T) {
+	key, storage, url := newCallbackTestServer(t, &TransactionRecord{
+		TransactionID:    "trx",
+		State:            TransactionJwtIssued,
+		JwtIssued:        true,
+		IrmaSessionToken: "session-of-trx",
+	})
+
+	results := testutil.ToFloat64(issuanceResults.WithLabelValues(string(irma.ServerStatusDone)))
+	resp := postJson(t, url, signSessionResult(t, key, "session-of-trx", irma.ServerStatusDone))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("result of the own session should be accepted, got %v", resp.StatusCode)
+	}
+
+	record, _ := storage.RetrieveTransaction(context.Background(), "trx")
+	if record.IssuanceResult != irma.ServerStatusDone {
+		t.Errorf("issuance result should be stored, got %v", record.IssuanceResult)
+	}
+	if counted := testutil.ToFloat64(issuanceResults.WithLabelValues(string(irma.ServerStatusDone))); counted != results+1 {
+		t.Errorf("issuance result should be counted, got %v", counted-results)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	log "yivi-iban-issuer/logging"
+
+	irmaserver "github.com/privacybydesign/irmago/server"
+)
+
+const SessionModeClient = "client"
+const SessionModeServer = "server"
+
+const irmaSessionTimeout = 10 * time.Second
+
+// IrmaSessionStarter starts issuance sessions at the IRMA server on behalf of the frontend,
+// so the signed issuance request never leaves the backend
+type IrmaSessionStarter interface {
+	StartIssuanceSession(ctx context.Context, transactionId TransactonId, callbackSecret string, account IbanAccount) (*irmaserver.SessionPackage, error)
+}
+
+// IrmaSessionClient starts sessions using the session API of the IRMA server.
+// When a requestor token is configured the plain session request is posted with that token,
+// otherwise the JWT created by the JwtCreator is posted.
+type IrmaSessionClient struct {
+	serverUrl      string
+	requestorToken string
+	credentials    []CredentialConfig
+	callbackUrl    string
+	jwtCreator     JwtCreator
+	client         *http.Client
+}
+
+func NewIrmaSessionClient(serverUrl string, requestorToken string, credentials []CredentialConfig, callbackUrl string, jwtCreator JwtCreator) *IrmaSessionClient {
+	return &IrmaSessionClient{
+		serverUrl:      strings.TrimSuffix(serverUrl, "/"),
+		requestorToken: requestorToken,
+		credentials:    credentials,
+		callbackUrl:    callbackUrl,
+		jwtCreator:     jwtCreator,
+		client:         &http.Client{Timeout: irmaSessionTimeout},
+	}
+}
+
+func (c *IrmaSessionClient) StartIssuanceSession(ctx context.Context, transactionId TransactonId, callbackSecret string, account IbanAccount) (*irmaserver.SessionPackage, error) {
+	req, err := c.createSessionRequest(ctx, transactionId, callbackSecret, account)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start irma session: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read irma session response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("irma server responded with status code %v: %s", resp.StatusCode, body)
+	}
+
+	var sessionPackage irmaserver.SessionPackage
+	err = json.Unmarshal(body, &sessionPackage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal irma session response: %w", err)
+	}
+
+	log.Info(ctx, "Started issuance session", "requestor_token", sessionPackage.Token)
+	return &sessionPackage, nil
+}
+
+func (c *IrmaSessionClient) createSessionRequest(ctx context.Context, transactionId TransactonId, callbackSecret string, account IbanAccount) (*http.Request, error) {
+	url := c.serverUrl + "/session"
+
+	if c.requestorToken == "" {
+		signed, err := c.jwtCreator.CreateJwt(transactionId, callbackSecret, account)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(signed))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		return req, nil
+	}
+
+	issuanceRequest := NewIbanIssuanceRequest(c.credentials, account)
+	requestorRequest := NewIbanRequestorRequest(issuanceRequest, c.callbackUrl, transactionId, callbackSecret)
+
+	body, err := json.Marshal(requestorRequest)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.requestorToken)
+	return req, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	irmaserver "github.com/privacybydesign/irmago/server"
+)
+
+// newTestIrmaServer starts a fake IRMA server that passes every session request to check
+// and responds with a session package for the session token
+func newTestIrmaServer(t *testing.T, token irma.RequestorToken, check func(r *http.Request, body []byte)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/session" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read session request: %v", err)
+		}
+		check(r, body)
+
+		json.NewEncoder(w).Encode(irmaserver.SessionPackage{
+			Token:           token,
+			SessionPtr:      &irma.Qr{URL: "https://irma.example.com/irma/session/client-token", Type: irma.ActionIssuing},
+			FrontendRequest: &irma.FrontendSessionRequest{Authorization: "frontend-authorization"},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSessionStartWithRequestorToken(t *testing.T) {
+	irmaServer := newTestIrmaServer(t, "session-token", func(r *http.Request, body []byte) {
+		if auth := r.Header.Get("Authorization"); auth != "requestor-token" {
+			t.Errorf("session request should carry the requestor token, got %q", auth)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("session request should be json, got %q", contentType)
+		}
+
+		var request irma.IdentityProviderRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatalf("session request is not an issuance request: %v", err)
+		}
+		if request.CallbackURL != "https://issuer.example.com"+IrmaCallbackPath+"trx/secret" {
+			t.Errorf("unexpected callback url %v", request.CallbackURL)
+		}
+		credentials := request.Request.Credentials
+		if len(credentials) != 1 || credentials[0].Attributes["iban"] != testAccount.Iban {
+			t.Errorf("session request should issue the verified iban, got %+v", credentials)
+		}
+	})
+
+	client := NewIrmaSessionClient(irmaServer.URL+"/", "requestor-token",
+		defaultCredentials("pbdf-staging.pbdf.iban", ""), "https://issuer.example.com", stubJwtCreator{})
+	sessionPackage, err := client.StartIssuanceSession(context.Background(), "trx", "secret", testAccount)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	if sessionPackage.Token != "session-token" || sessionPackage.SessionPtr == nil {
+		t.Errorf("unexpected session package %+v", sessionPackage)
+	}
+}
+
+func TestSessionStartWithJwt(t *testing.T) {
+	keyPath, publicKey := writePkcs1Key(t, t.TempDir(), "key.pem")
+	jwtCreator := newTestJwtCreator(t, keyPath, "", "")
+
+	irmaServer := newTestIrmaServer(t, "session-token", func(r *http.Request, body []byte) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("jwt session request shouldn't carry a requestor token, got %q", auth)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "text/plain" {
+			t.Errorf("jwt session request should be text/plain, got %q", contentType)
+		}
+
+		claims, _ := parseSignedJwt(t, string(body), publicKey)
+		if claims["iss"] != "iban_issuer" || claims["sub"] != "issue_request" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+	})
+
+	client := NewIrmaSessionClient(irmaServer.URL, "", nil, "", jwtCreator)
+	sessionPackage, err := client.StartIssuanceSession(context.Background(), "trx", "secret", testAccount)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	if sessionPackage.Token != "session-token" {
+		t.Errorf("unexpected session token %v", sessionPackage.Token)
+	}
+}
+
+func TestSessionStartFailsOnIrmaServerError(t *testing.T) {
+	irmaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(irmaServer.Close)
+
+	client := NewIrmaSessionClient(irmaServer.URL, "wrong-token", nil, "", stubJwtCreator{})
+	if _, err := client.StartIssuanceSession(context.Background(), "trx", "secret", testAccount); err == nil {
+		t.Error("session start should fail when the IRMA server refuses it")
+	}
+}
+
+func TestStatusInServerModeOnlyReturnsSessionPointer(t *testing.T) {
+	var callbackUrl string
+	irmaServer := newTestIrmaServer(t, "session-token", func(r *http.Request, body []byte) {
+		var request irma.IdentityProviderRequest
+		json.Unmarshal(body, &request)
+		callbackUrl = request.CallbackURL
+	})
+	storage := newTestTokenStorage(t)
+	cookie := storeStartedTransaction(t, storage, "trx")
+
+	server := newTestServer(t, &ServerState{
+		irmaServerURL: irmaServer.URL,
+		ibanChecker:   &stubIbanChecker{status: successStatus("trx")},
+		jwtCreator:    stubJwtCreator{},
+		tokenStorage:  storage,
+		bankDirectory: newTestBankDirectory(t),
+		sessionStarter: NewIrmaSessionClient(irmaServer.URL, "requestor-token",
+			defaultCredentials("pbdf-staging.pbdf.iban", ""), "https://issuer.example.com", stubJwtCreator{}),
+	})
+
+	resp := postJson(t, server.URL+"/api/status", `{"transaction_id": "trx"}`, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+	var message map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	for _, field := range []string{"jwt", "irma_server_url"} {
+		if _, ok := message[field]; ok {
+			t.Errorf("response shouldn't contain %v in server mode", field)
+		}
+	}
+	for _, field := range []string{"session_ptr", "frontend_request"} {
+		if _, ok := message[field]; !ok {
+			t.Errorf("response should contain %v in server mode", field)
+		}
+	}
+
+	record, err := storage.RetrieveTransaction(context.Background(), "trx")
+	if err != nil {
+		t.Fatalf("failed to retrieve transaction: %v", err)
+	}
+	if record.IrmaSessionToken != "session-token" {
+		t.Errorf("session token should be stored with the transaction, got %q", record.IrmaSessionToken)
+	}
+	secret := callbackUrl[strings.LastIndex(callbackUrl, "/")+1:]
+	if secret == "" || hashNonce(secret) != record.IrmaCallbackHash {
+		t.Errorf("hash of the secret in callback url %v should be stored with the transaction", callbackUrl)
+	}
+}
@@ -1,62 +1,124 @@
 package main
 
 import (
-	"crypto/rsa"
-	"os"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
 )
 
 type JwtCreator interface {
-	CreateJwt(fullname string, iban string, bic string) (jwt string, err error)
+	// The callback secret ends up in the callback url, so the session result can be tied to the transaction
+	CreateJwt(transactionId TransactonId, callbackSecret string, account IbanAccount) (jwt string, err error)
+	// Checks whether a request can be signed, without counting it as a created JWT
+	Probe() error
 }
 
+// NewIrmaJwtCreator loads the key set at keySetPath, or when that's empty the single key at privateKeyPath.
+// The signing algorithm of the single key is derived from its type when algorithm is empty.
 func NewIrmaJwtCreator(privateKeyPath string,
+	algorithm string,
+	keySetPath string,
 	issuerId string,
-	crediential string,
+	credentials []CredentialConfig,
+	callbackUrl string,
 ) (*DefaultJwtCreator, error) {
-	keyBytes, err := os.ReadFile(privateKeyPath)
+	loadKeys := func() (*JwtKeySet, error) {
+		if keySetPath != "" {
+			return LoadJwtKeySet(keySetPath)
+		}
+		return LoadSingleJwtKey(privateKeyPath, algorithm)
+	}
 
+	keySet, err := loadKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+	jc := &DefaultJwtCreator{
+		loadKeys:    loadKeys,
+		issuerId:    issuerId,
+		credentials: credentials,
+		callbackUrl: callbackUrl,
+	}
+	jc.keySet.Store(keySet)
+	return jc, nil
+}
+
+type DefaultJwtCreator struct {
+	// Swapped as a whole when the keys are reloaded, so signing never sees a partial key set
+	keySet      atomic.Pointer[JwtKeySet]
+	loadKeys    func() (*JwtKeySet, error)
+	issuerId    string
+	credentials []CredentialConfig
+	callbackUrl string
+}
+
+// IbanAccount holds the details of the verified account that can end up in the credentials
+type IbanAccount struct {
+	Fullname      string
+	Iban          string
+	Bic           string
+	BankName      string
+	IdealIssuerId string
+	VerifiedAt    time.Time
+}
+
+// LogValue leaves out the name and IBAN of the account holder when the account is logged
+func (a IbanAccount) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("bic", a.Bic),
+		slog.String("bank_name", a.BankName),
+		slog.String("ideal_issuer_id", a.IdealIssuerId),
+		slog.Time("verified_at", a.VerifiedAt),
+	)
+}
+
+// NewIbanRequestorRequest wraps the issuance request with the options for the IRMA server.
+// When a callback url is configured, the IRMA server posts the session result for the
+// transaction to the callback endpoint of this server, with the callback secret in the url.
+func NewIbanRequestorRequest(request *irma.IssuanceRequest, callbackUrl string, transactionId TransactonId, callbackSecret string) *irma.IdentityProviderRequest {
+	requestorRequest := &irma.IdentityProviderRequest{Request: request}
+	if callbackUrl != "" {
+		requestorRequest.CallbackURL = strings.TrimSuffix(callbackUrl, "/") + IrmaCallbackPath + string(transactionId) + "/" + callbackSecret
+	}
+	return requestorRequest
+}
 
+func (jc *DefaultJwtCreator) CreateJwt(transactionId TransactonId, callbackSecret string, account IbanAccount) (string, error) {
+	signed, err := jc.sign(transactionId, callbackSecret, account)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return &DefaultJwtCreator{
-		issuerId:   issuerId,
-		privateKey: privateKey,
-		credential: crediential,
-	}, nil
+	jwtsCreated.Inc()
+	return signed, nil
 }
 
-type DefaultJwtCreator struct {
-	privateKey *rsa.PrivateKey
-	issuerId   string
-	credential string
-}
-
-func (jc *DefaultJwtCreator) CreateJwt(fullname string, iban string, bic string) (string, error) {
-	issuanceRequest := irma.NewIssuanceRequest([]*irma.CredentialRequest{
-		{
-			CredentialTypeID: irma.NewCredentialTypeIdentifier(jc.credential),
-			Attributes: map[string]string{
-				"fullname": fullname,
-				"iban":     iban,
-				"bic":      bic,
-			},
-		},
-	})
-
-	return irma.SignSessionRequest(
-		issuanceRequest,
-		jwt.GetSigningMethod(jwt.SigningMethodRS256.Alg()),
-		jc.privateKey,
-		jc.issuerId,
-	)
+func (jc *DefaultJwtCreator) Probe() error {
+	_, err := jc.sign("readiness-probe", "", IbanAccount{Fullname: "probe", Iban: "NL91ABNA0417164300", Bic: "probe", BankName: "probe", VerifiedAt: time.Now()})
+	return err
+}
+
+func (jc *DefaultJwtCreator) sign(transactionId TransactonId, callbackSecret string, account IbanAccount) (string, error) {
+	issuanceRequest := NewIbanIssuanceRequest(jc.credentials, account)
+	requestorRequest := NewIbanRequestorRequest(issuanceRequest, jc.callbackUrl, transactionId, callbackSecret)
+
+	key := jc.keySet.Load().active
+	issuerId := jc.issuerId
+	if key.issuerId != "" {
+		issuerId = key.issuerId
+	}
+
+	claims := irma.NewIdentityProviderJwt(issuerId, nil)
+	claims.Request = requestorRequest
+
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.kid != "" {
+		token.Header["kid"] = key.kid
+	}
+	return token.SignedString(key.privateKey)
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+	log "yivi-iban-issuer/logging"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Interval at which the key files are checked for changes, when not configured
+const defaultJwtKeyReloadInterval = 30 * time.Second
+
+// JwtKeySetConfig is the format of the file at jwt_key_set_path. All keys are loaded,
+// so a new key can be added and checked before it's made the active one.
+type JwtKeySetConfig struct {
+	ActiveKid string         `json:"active_kid"`
+	Keys      []JwtKeyConfig `json:"keys"`
+}
+
+type JwtKeyConfig struct {
+	Kid string `json:"kid"`
+	// Relative paths are relative to the key set file
+	PrivateKeyPath string `json:"private_key_path"`
+	// Signing algorithm, e.g. RS256, derived from the type of the key when empty
+	Algorithm string `json:"algorithm,omitempty"`
+	// Requestor name under which the IRMA server knows the public key of this key, used as the
+	// issuer of the JWT. The IRMA server has one key per requestor and ignores the kid, so every
+	// key needs its own requestor. Falls back to issuer_id when empty.
+	IssuerId string `json:"issuer_id,omitempty"`
+}
+
+type jwtSigningKey struct {
+	// Empty for the single key from jwt_private_key_path, in which case no kid header is set
+	kid        string
+	privateKey crypto.Signer
+	method     jwt.SigningMethod
+	// Empty when the configured issuer_id is used
+	issuerId string
+}
+
+// JwtKeySet holds the loaded signing keys, of which the active one is used for signing
+type JwtKeySet struct {
+	keys   map[string]*jwtSigningKey
+	active *jwtSigningKey
+	// The files the keys were loaded from, with their modification times at load time
+	files map[string]time.Time
+}
+
+// parsePrivateKey parses a PEM encoded RSA (PKCS#1), EC (SEC 1) or PKCS#8 private key.
+// PKCS#8 keys can be RSA, ECDSA or Ed25519 keys.
+func parsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %v", block.Type)
+	}
+}
+
+// signingMethodFor returns the configured signing method after checking it fits the key,
+// or the default method for the type of key when none is configured
+func signingMethodFor(key crypto.Signer, algorithm string) (jwt.SigningMethod, error) {
+	var defaultAlgorithm string
+	var compatible []string
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		defaultAlgorithm = jwt.SigningMethodRS256.Alg()
+		compatible = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PrivateKey:
+		// The curve determines the algorithm for ECDSA
+		switch key.Curve {
+		case elliptic.P256():
+			defaultAlgorithm = jwt.SigningMethodES256.Alg()
+		case elliptic.P384():
+			defaultAlgorithm = jwt.SigningMethodES384.Alg()
+		case elliptic.P521():
+			defaultAlgorithm = jwt.SigningMethodES512.Alg()
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %v", key.Curve.Params().Name)
+		}
+		compatible = []string{defaultAlgorithm}
+	case ed25519.PrivateKey:
+		defaultAlgorithm = jwt.SigningMethodEdDSA.Alg()
+		compatible = []string{defaultAlgorithm}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	if algorithm == "" {
+		algorithm = defaultAlgorithm
+	}
+	if !slices.Contains(compatible, algorithm) {
+		return nil, fmt.Errorf("signing algorithm %v can't be used with a %T", algorithm, key)
+	}
+	return jwt.GetSigningMethod(algorithm), nil
+}
+
+func readSigningKey(kid string, path string, algorithm string) (*jwtSigningKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	method, err := signingMethodFor(privateKey, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if method != jwt.SigningMethodRS256 {
+		log.Warn(context.Background(), "the IRMA server only accepts RS256 requestor JWTs unless it's extended to support other algorithms",
+			"kid", kid, "algorithm", method.Alg())
+	}
+	return &jwtSigningKey{kid: kid, privateKey: privateKey, method: method}, nil
+}
+
+// LoadSingleJwtKey loads a key set with only the key at the given path, without a key id
+func LoadSingleJwtKey(privateKeyPath string, algorithm string) (*JwtKeySet, error) {
+	key, err := readSigningKey("", privateKeyPath, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JwtKeySet{
+		keys:   map[string]*jwtSigningKey{"": key},
+		active: key,
+		files:  modificationTimes(privateKeyPath),
+	}, nil
+}
+
+// LoadJwtKeySet loads all keys listed in the key set file
+func LoadJwtKeySet(path string) (*JwtKeySet, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config JwtKeySetConfig
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwt key set: %w", err)
+	}
+	if len(config.Keys) == 0 {
+		return nil, errors.New("jwt key set contains no keys")
+	}
+
+	keySet := &JwtKeySet{
+		keys:  make(map[string]*jwtSigningKey),
+		files: modificationTimes(path),
+	}
+	for _, keyConfig := range config.Keys {
+		if keyConfig.Kid == "" {
+			return nil, errors.New("every key in the jwt key set needs a kid")
+		}
+		if _, ok := keySet.keys[keyConfig.Kid]; ok {
+			return nil, fmt.Errorf("kid %v occurs more than once in the jwt key set", keyConfig.Kid)
+		}
+
+		keyPath := keyConfig.PrivateKeyPath
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		key, err := readSigningKey(keyConfig.Kid, keyPath, keyConfig.Algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %v: %w", keyConfig.Kid, err)
+		}
+
+		key.issuerId = keyConfig.IssuerId
+		keySet.keys[keyConfig.Kid] = key
+		for file, modTime := range modificationTimes(keyPath) {
+			keySet.files[file] = modTime
+		}
+	}
+
+	active, ok := keySet.keys[config.ActiveKid]
+	if !ok {
+		return nil, fmt.Errorf("active kid %v is not in the jwt key set", config.ActiveKid)
+	}
+	keySet.active = active
+	return keySet, nil
+}
+
+func modificationTimes(paths ...string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			times[path] = info.ModTime()
+		} else {
+			times[path] = time.Time{}
+		}
+	}
+	return times
+}
+
+// changed reports whether any of the files was modified since the key set was loaded
+func (k *JwtKeySet) changed() bool {
+	for path, loadedModTime := range modificationTimes(slices.Collect(maps.Keys(k.files))...) {
+		if !loadedModTime.Equal(k.files[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload loads the keys again. When that fails the current keys stay in use.
+func (jc *DefaultJwtCreator) Reload() error {
+	keySet, err := jc.loadKeys()
+	if err != nil {
+		return err
+	}
+	jc.keySet.Store(keySet)
+	log.Info(context.Background(), "loaded jwt signing keys", "active_kid", keySet.active.kid)
+	return nil
+}
+
+// WatchKeyFiles reloads the keys when one of their files changes, until stop is closed
+func (jc *DefaultJwtCreator) WatchKeyFiles(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !jc.keySet.Load().changed() {
+				continue
+			}
+			err := jc.Reload()
+			if err != nil {
+				log.Error(context.Background(), "failed to reload changed jwt signing keys", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// writePemKey writes the key to a file in dir and returns its path
+func writePemKey(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return path
+}
+
+func writePkcs1Key(t *testing.T, dir string, name string) (string, crypto.PublicKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return writePemKey(t, dir, name, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), &key.PublicKey
+}
+
+// parseSignedJwt verifies the JWT with the public key and returns its claims and kid
+func parseSignedJwt(t *testing.T, signed string, publicKey crypto.PublicKey) (jwt.MapClaims, string) {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (any, error) {
+		return publicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("jwt doesn't verify with the public key: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return claims, kid
+}
+
+func newTestJwtCreator(t *testing.T, privateKeyPath string, algorithm string, keySetPath string) *DefaultJwtCreator {
+	t.Helper()
+	creator, err := NewIrmaJwtCreator(privateKeyPath, algorithm, keySetPath, "iban_issuer",
+		defaultCredentials("pbdf-staging.pbdf.iban", ""), "")
+	if err != nil {
+		t.Fatalf("failed to create jwt creator: %v", err)
+	}
+	return creator
+}
+
+var testAccount = IbanAccount{Fullname: "J. Doe", Iban: "NL91ABNA0417164300", Bic: "ABNANL2A", VerifiedAt: time.Now()}
+
+func TestKeySetSignsWithIssuerOfActiveKey(t *testing.T) {
+	dir := t.TempDir()
+	_, oldPublicKey := writePkcs1Key(t, dir, "old.pem")
+	_, newPublicKey := writePkcs1Key(t, dir, "new.pem")
+
+	writeKeySet := func(activeKid string) string {
+		keySet, _ := json.Marshal(JwtKeySetConfig{
+			ActiveKid: activeKid,
+			Keys: []JwtKeyConfig{
+				{Kid: "old", PrivateKeyPath: "old.pem"},
+				{Kid: "new", PrivateKeyPath: "new.pem", IssuerId: "iban_issuer_new"},
+			},
+		})
+		path := filepath.Join(dir, "keys.json")
+		if err := os.WriteFile(path, keySet, 0600); err != nil {
+			t.Fatalf("failed to write key set: %v", err)
+		}
+		return path
+	}
+
+	creator := newTestJwtCreator(t, "", "", writeKeySet("old"))
+	signed, err := creator.CreateJwt("trx", "secret", testAccount)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	claims, kid := parseSignedJwt(t, signed, oldPublicKey)
+	if kid != "old" || claims["iss"] != "iban_issuer" {
+		t.Errorf("key without issuer_id should sign as issuer_id, got kid %v and iss %v", kid, claims["iss"])
+	}
+
+	writeKeySet("new")
+	if err := creator.Reload(); err != nil {
+		t.Fatalf("failed to reload keys: %v", err)
+	}
+	signed, err = creator.CreateJwt("trx", "secret", testAccount)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	claims, kid = parseSignedJwt(t, signed, newPublicKey)
+	if kid != "new" || claims["iss"] != "iban_issuer_new" {
+		t.Errorf("key should sign as its own issuer, got kid %v and iss %v", kid, claims["iss"])
+	}
+}
+
+func TestSingleKeySignsVerifiableJwt(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ed25519PublicKey, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+
+	pkcs8 := func(key any) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		return der
+	}
+	sec1 := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		return der
+	}
+
+	tests := []struct {
+		name      string
+		blockType string
+		der       []byte
+		algorithm string
+		publicKey crypto.PublicKey
+		alg       string
+	}{
+		{"PKCS#1 RSA", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), "", &rsaKey.PublicKey, "RS256"},
+		{"PKCS#8 RSA", "PRIVATE KEY", pkcs8(rsaKey), "", &rsaKey.PublicKey, "RS256"},
+		{"PKCS#8 RSA with PS256", "PRIVATE KEY", pkcs8(rsaKey), "PS256", &rsaKey.PublicKey, "PS256"},
+		{"SEC 1 EC P-256", "EC PRIVATE KEY", sec1(p256Key), "", &p256Key.PublicKey, "ES256"},
+		{"PKCS#8 EC P-384", "PRIVATE KEY", pkcs8(p384Key), "", &p384Key.PublicKey, "ES384"},
+		{"PKCS#8 Ed25519", "PRIVATE KEY", pkcs8(ed25519Key), "", ed25519PublicKey, "EdDSA"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writePemKey(t, t.TempDir(), "key.pem", tc.blockType, tc.der)
+			creator := newTestJwtCreator(t, path, tc.algorithm, "")
+
+			signed, err := creator.CreateJwt("trx", "secret", testAccount)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+			claims, kid := parseSignedJwt(t, signed, tc.publicKey)
+			if kid != "" {
+				t.Errorf("single key shouldn't set a kid, got %v", kid)
+			}
+			if claims["iss"] != "iban_issuer" {
+				t.Errorf("unexpected issuer %v", claims["iss"])
+			}
+
+			token, _, _ := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+			if token.Method.Alg() != tc.alg {
+				t.Errorf("expected algorithm %v, got %v", tc.alg, token.Method.Alg())
+			}
+		})
+	}
+}
+
+func TestSigningAlgorithmMustFitKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ecKey)
+	path := writePemKey(t, t.TempDir(), "key.pem", "EC PRIVATE KEY", der)
+
+	if _, err := LoadSingleJwtKey(path, "RS256"); err == nil {
+		t.Error("RS256 shouldn't be accepted for an EC key")
+	}
+	if _, err := LoadSingleJwtKey(path, "ES384"); err == nil {
+		t.Error("ES384 shouldn't be accepted for a P-256 key")
+	}
+}
@@ -1,27 +1,147 @@
 package logging
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 )
 
-var (
-	Info  *log.Logger
-	Error *log.Logger
+const (
+	FormatText = "text"
+	FormatJson = "json"
 )
 
-func init() {
-	Error = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	Info = log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+type Config struct {
+	// Either "text" (default) or "json"
+	Format string `json:"format,omitempty"`
+	// One of "debug", "info" (default), "warn" or "error"
+	Level string `json:"level,omitempty"`
 }
 
-func InitFileLogger(fileName string) {
-	logFile, err := os.Create(fileName)
+var logger = newLogger(os.Stderr, FormatText, slog.LevelInfo)
 
+func parseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := parsed.UnmarshalText([]byte(level))
 	if err != nil {
-		log.Fatalf("failed to open error log file: %v", err)
+		return 0, fmt.Errorf("invalid log level %v", level)
+	}
+	return parsed, nil
+}
+
+func (c Config) Validate() error {
+	if c.Format != "" && c.Format != FormatText && c.Format != FormatJson {
+		return fmt.Errorf("invalid log format %v, should be %v or %v", c.Format, FormatText, FormatJson)
+	}
+	_, err := parseLevel(c.Level)
+	return err
+}
+
+// Init replaces the logger with one with the configured format and level
+func Init(config Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	level, _ := parseLevel(config.Level)
+	logger = newLogger(os.Stderr, config.Format, level)
+	return nil
+}
+
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, FormatJson) {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// ------------------------------------------------------------------------------
+
+type contextKey struct{}
+
+// WithAttrs returns a context of which all logs carry the given attributes,
+// e.g. the route or the transaction a request is about
+func WithAttrs(ctx context.Context, args ...any) context.Context {
+	existing, _ := ctx.Value(contextKey{}).([]any)
+	attrs := make([]any, 0, len(existing)+len(args))
+	attrs = append(attrs, existing...)
+	attrs = append(attrs, args...)
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+// contextHandler adds the attributes stored in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(contextKey{}).([]any); ok {
+		record.Add(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// ------------------------------------------------------------------------------
+
+func Debug(ctx context.Context, msg string, args ...any) {
+	log(ctx, slog.LevelDebug, msg, args...)
+}
+
+func Info(ctx context.Context, msg string, args ...any) {
+	log(ctx, slog.LevelInfo, msg, args...)
+}
+
+func Warn(ctx context.Context, msg string, args ...any) {
+	log(ctx, slog.LevelWarn, msg, args...)
+}
+
+func Error(ctx context.Context, msg string, args ...any) {
+	log(ctx, slog.LevelError, msg, args...)
+}
+
+// Fatal logs the message as an error and exits the process
+func Fatal(ctx context.Context, msg string, args ...any) {
+	log(ctx, slog.LevelError, msg, args...)
+	os.Exit(1)
+}
+
+func log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !logger.Enabled(ctx, level) {
+		return
 	}
 
-	Error = log.New(logFile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	Info = log.New(logFile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	// Skip runtime.Callers, log and the exported function, so the source is the caller
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	record := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	record.Add(args...)
+	_ = logger.Handler().Handle(ctx, record)
 }
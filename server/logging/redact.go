@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"yivi-iban-issuer/iban"
+)
+
+const redacted = "[redacted]"
+
+// Attributes of which the value is never logged. Unlike IBANs, names can't be recognized
+// in free text, so they are only redacted under one of these keys; types holding a name
+// implement slog.LogValuer to leave it out.
+var sensitiveKeys = map[string]bool{
+	"iban":            true,
+	"name":            true,
+	"fullname":        true,
+	"merchant_token":  true,
+	"password":        true,
+	"authorization":   true,
+	"requestor_token": true,
+	"jwt":             true,
+}
+
+// Candidates for IBANs in free text, which are only masked when their checksum is valid
+var ibanCandidate = regexp.MustCompile(`\b[A-Z]{2}[0-9]{2}(?: ?[A-Z0-9]){11,30}\b`)
+
+var (
+	secrets      []string
+	secretsMutex sync.RWMutex
+)
+
+// RegisterSecret makes sure the value is redacted wherever it occurs in a log,
+// e.g. for tokens and passwords from the config
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// redactAttr replaces the values of sensitive attributes and masks the IBANs and secrets
+// in all other strings, including the message and errors
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactString(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, redactString(value.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, redactString(value.String()))
+		}
+	}
+	return attr
+}
+
+func redactString(value string) string {
+	secretsMutex.RLock()
+	for _, secret := range secrets {
+		value = strings.ReplaceAll(value, secret, redacted)
+	}
+	secretsMutex.RUnlock()
+
+	return ibanCandidate.ReplaceAllStringFunc(value, func(candidate string) string {
+		normalized, err := iban.Validate(candidate)
+		if err != nil {
+			return candidate
+		}
+		return iban.Mask(normalized)
+	})
+}
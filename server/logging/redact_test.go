@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLogs replaces the logger by one writing json to the returned buffer for the duration of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	original := logger
+	logger = newLogger(&buf, FormatJson, slog.LevelDebug)
+	t.Cleanup(func() { logger = original })
+	return &buf
+}
+
+func TestSensitiveKeysAreRedacted(t *testing.T) {
+	for key := range sensitiveKeys {
+		t.Run(key, func(t *testing.T) {
+			buf := captureLogs(t)
+			Info(context.Background(), "test", key, "J. Doe")
+
+			if strings.Contains(buf.String(), "J. Doe") {
+				t.Errorf("value of %v should be redacted, got %v", key, buf.String())
+			}
+			if !strings.Contains(buf.String(), redacted) {
+				t.Errorf("value of %v should be replaced by %v, got %v", key, redacted, buf.String())
+			}
+		})
+	}
+
+	t.Run("key in other case", func(t *testing.T) {
+		buf := captureLogs(t)
+		Info(context.Background(), "test", "IBAN", "J. Doe")
+		if strings.Contains(buf.String(), "J. Doe") {
+			t.Errorf("value of IBAN should be redacted, got %v", buf.String())
+		}
+	})
+
+	t.Run("key from the context", func(t *testing.T) {
+		buf := captureLogs(t)
+		Info(WithAttrs(context.Background(), "fullname", "J. Doe"), "test")
+		if strings.Contains(buf.String(), "J. Doe") {
+			t.Errorf("value of fullname in the context should be redacted, got %v", buf.String())
+		}
+	})
+}
+
+func TestIbansAreMasked(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     func(ctx context.Context)
+		leaked  string
+		present string
+	}{
+		{
+			name:    "in the message",
+			log:     func(ctx context.Context) { Info(ctx, "checked NL91ABNA0417164300") },
+			leaked:  "NL91ABNA0417164300",
+			present: "NL91**********4300",
+		},
+		{
+			name:    "with spaces in the message",
+			log:     func(ctx context.Context) { Info(ctx, "checked NL91 ABNA 0417 1643 00") },
+			leaked:  "ABNA 0417",
+			present: "NL91**********4300",
+		},
+		{
+			name:    "in an error",
+			log:     func(ctx context.Context) { Error(ctx, "failed", "error", errors.New("no bank for NL91ABNA0417164300")) },
+			leaked:  "NL91ABNA0417164300",
+			present: "NL91**********4300",
+		},
+		{
+			name:    "in a string attribute",
+			log:     func(ctx context.Context) { Info(ctx, "test", "detail", "account NL91ABNA0417164300") },
+			leaked:  "NL91ABNA0417164300",
+			present: "NL91**********4300",
+		},
+		{
+			name:    "invalid checksum is left as is",
+			log:     func(ctx context.Context) { Info(ctx, "reference NL00ABNA0417164300") },
+			present: "NL00ABNA0417164300",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := captureLogs(t)
+			tc.log(context.Background())
+
+			if tc.leaked != "" && strings.Contains(buf.String(), tc.leaked) {
+				t.Errorf("log should not contain %v, got %v", tc.leaked, buf.String())
+			}
+			if !strings.Contains(buf.String(), tc.present) {
+				t.Errorf("log should contain %v, got %v", tc.present, buf.String())
+			}
+		})
+	}
+}
+
+func TestRegisteredSecretsAreRedacted(t *testing.T) {
+	const secret = "s3cr3t-test-token"
+	RegisterSecret(secret)
+
+	buf := captureLogs(t)
+	ctx := context.Background()
+	Info(ctx, "token "+secret+" in the message")
+	Info(ctx, "test", "detail", "Bearer "+secret)
+	Error(ctx, "test", "error", errors.New("rejected "+secret))
+
+	if strings.Contains(buf.String(), secret) {
+		t.Errorf("registered secret should be redacted, got %v", buf.String())
+	}
+	if strings.Count(buf.String(), redacted) != 3 {
+		t.Errorf("expected the secret to be redacted in all 3 logs, got %v", buf.String())
+	}
+}
+
+func TestNamesAreOnlyRedactedUnderKnownKeys(t *testing.T) {
+	buf := captureLogs(t)
+	Info(context.Background(), "test", "holder", "J. Doe")
+
+	// Names can't be recognized in free text, which is why the types holding them implement slog.LogValuer
+	if !strings.Contains(buf.String(), "J. Doe") {
+		t.Errorf("a name under an unknown key is expected to be logged, got %v", buf.String())
+	}
+}
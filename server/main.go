@@ -1,107 +1,374 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"yivi-iban-issuer/bankdir"
 	log "yivi-iban-issuer/logging"
 )
 
 type Config struct {
 	ServerConfig ServerConfig `json:"server_config"`
+	LogConfig    log.Config   `json:"log_config,omitempty"`
 
 	JwtPrivateKeyPath string `json:"jwt_private_key_path"`
-	IrmaServerUrl     string `json:"irma_server_url"`
-	IssuerId          string `json:"issuer_id"`
-	FullCredential    string `json:"full_credential"`
+	// Algorithm to sign with the key at jwt_private_key_path, derived from the type of the key when empty
+	JwtSigningAlgorithm string `json:"jwt_signing_algorithm,omitempty"`
+	// Key set with several signing keys and the active one, used instead of jwt_private_key_path when set
+	JwtKeySetPath string `json:"jwt_key_set_path,omitempty"`
+	// Interval at which the key files are checked for changes, defaults to 30 seconds.
+	// The keys are also reloaded on SIGHUP.
+	JwtKeyReloadIntervalMs int64 `json:"jwt_key_reload_interval_ms,omitempty"`
 
+	IrmaServerUrl  string `json:"irma_server_url"`
+	IssuerId       string `json:"issuer_id"`
+	FullCredential string `json:"full_credential"`
+	// Credentials to issue with their attribute mapping, instead of only full_credential with the default attributes
+	Credentials []CredentialConfig `json:"credentials,omitempty"`
+
+	// Either "client" (default), where the frontend receives the signed JWT and starts the session,
+	// or "server", where the backend starts the session and only hands out the session pointer
+	SessionMode        string `json:"session_mode,omitempty"`
+	IrmaRequestorToken string `json:"irma_requestor_token,omitempty"`
+
+	// Public url of this server, to which the IRMA server posts the issuance session results.
+	// The results are verified with the public key of the IRMA server.
+	IrmaCallbackUrl         string `json:"irma_callback_url,omitempty"`
+	IrmaServerPublicKeyPath string `json:"irma_server_public_key_path,omitempty"`
+
+	// JSON file with the banks to derive the bic from, defaults to the directory embedded in the binary
+	BankDirectoryPath string `json:"bank_directory_path,omitempty"`
+	// Attribute of full_credential in which the name of the bank is issued, not issued when empty
+	BankNameAttribute string `json:"bank_name_attribute,omitempty"`
+
+	IbanBackend         string              `json:"iban_backend,omitempty"`
 	CmIbanConfig        CmIbanConfig        `json:"cm_iban_config,omitempty"`
+	MockIbanConfig      MockIbanConfig      `json:"mock_iban_config,omitempty"`
 	StorageType         string              `json:"storage_type"`
 	RedisConfig         RedisConfig         `json:"redis_config,omitempty"`
 	RedisSentinelConfig RedisSentinelConfig `json:"redis_sentinel_config,omitempty"`
+
+	// The mock iban backend lets anyone choose the name and iban that are issued, so it refuses
+	// to start unless this is set. Never set it next to a production IRMA requestor key.
+	AllowInsecureMock bool `json:"allow_insecure_mock,omitempty"`
+
+	// Time after which stored transactions expire, defaults to 24 hours
+	StorageTtlMs int64 `json:"storage_ttl_ms,omitempty"`
+	// Interval at which the memory storage evicts expired transactions, defaults to a minute
+	StorageCleanupIntervalMs int64 `json:"storage_cleanup_interval_ms,omitempty"`
+	// Time a single storage operation may take, defaults to 2 seconds
+	StorageOperationTimeoutMs int64 `json:"storage_operation_timeout_ms,omitempty"`
+
+	RateLimitConfig RateLimitConfig `json:"rate_limit_config,omitempty"`
+
+	// Whether /api/health/ready also checks that the iban backend can be reached
+	ReadinessCheckIbanBackend bool `json:"readiness_check_iban_backend,omitempty"`
 }
 
+// Command that only validates the config and exits
+const checkConfigCommand = "check-config"
+
 func main() {
+	ctx := context.Background()
 	configPath := flag.String("config", "", "Path for the config.json to use")
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [%v] --config <path>\n", os.Args[0], checkConfigCommand)
+		flag.PrintDefaults()
+	}
+
+	args := os.Args[1:]
+	checkConfigOnly := len(args) > 0 && args[0] == checkConfigCommand
+	if checkConfigOnly {
+		args = args[1:]
+	}
+	// Parse exits on invalid flags
+	_ = flag.CommandLine.Parse(args)
 
 	if *configPath == "" {
-		log.Error.Fatalf("please provide a config path using the --config flag")
+		log.Fatal(ctx, "please provide a config path using the --config flag")
 	}
 
-	log.Info.Printf("using config: %v", *configPath)
+	log.Info(ctx, "using config", "path", *configPath)
 
 	config, err := readConfigFile(*configPath)
 	if err != nil {
-		log.Error.Fatalf("failed to read config file: %v", err)
+		log.Fatal(ctx, "failed to read config file", "error", err)
 	}
 
-	log.Info.Printf("hosting on: %v:%v", config.ServerConfig.Host, config.ServerConfig.Port)
+	err = applyEnvOverrides(&config, os.LookupEnv)
+	if err != nil {
+		log.Fatal(ctx, "failed to apply config overrides from the environment", "error", err)
+	}
+
+	registerLogSecrets(&config)
+
+	err = config.Validate()
+	if checkConfigOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config is invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+		return
+	}
+	if err != nil {
+		log.Fatal(ctx, "config is invalid", "error", err)
+	}
+
+	err = log.Init(config.LogConfig)
+	if err != nil {
+		log.Fatal(ctx, "failed to initialize logging", "error", err)
+	}
+
+	log.Info(ctx, "hosting", "host", config.ServerConfig.Host, "port", config.ServerConfig.Port)
 
 	jwtCreator, err := NewIrmaJwtCreator(
 		config.JwtPrivateKeyPath,
+		config.JwtSigningAlgorithm,
+		config.JwtKeySetPath,
 		config.IssuerId,
-		config.FullCredential,
+		config.credentialConfigs(),
+		config.IrmaCallbackUrl,
 	)
 	if err != nil {
-		log.Error.Fatalf("failed to instantiate jwt creator: %v", err)
+		log.Fatal(ctx, "failed to instantiate jwt creator", "error", err)
+	}
+
+	resultVerifier, err := createResultVerifier(&config)
+	if err != nil {
+		log.Fatal(ctx, "failed to instantiate session result verifier", "error", err)
+	}
+
+	bankDirectory, err := createBankDirectory(&config)
+	if err != nil {
+		log.Fatal(ctx, "failed to load bank directory", "error", err)
 	}
 
 	ibanChecker, err := createIbanBackend(&config)
 	if err != nil {
-		log.Error.Fatalf("failed to instantiate sms backend: %v", err)
+		log.Fatal(ctx, "failed to instantiate iban backend", "error", err)
 	}
 
 	tokenStorage, err := createTokenStorage(&config)
 	if err != nil {
-		log.Error.Fatalf("failed to instantiate token storage: %v", err)
+		log.Fatal(ctx, "failed to instantiate token storage", "error", err)
 	}
 
-	serverState := ServerState{
-		irmaServerURL: config.IrmaServerUrl,
-		ibanChecker:   ibanChecker,
-		jwtCreator:    jwtCreator,
-		tokenStorage:  tokenStorage,
+	rateLimiter, err := createRateLimiter(&config, tokenStorage)
+	if err != nil {
+		log.Fatal(ctx, "failed to instantiate rate limiter", "error", err)
 	}
 
-	server, err := NewServer(&serverState, config.ServerConfig)
+	sessionStarter, err := createSessionStarter(&config, jwtCreator)
 	if err != nil {
-		log.Error.Fatalf("failed to create server: %v", err)
+		log.Fatal(ctx, "failed to instantiate session starter", "error", err)
 	}
 
-	err = server.ListenAndServe()
+	serverState := &ServerState{
+		irmaServerURL:  config.IrmaServerUrl,
+		ibanChecker:    ibanChecker,
+		jwtCreator:     jwtCreator,
+		tokenStorage:   instrumentedTokenStorage{timeoutTokenStorage{tokenStorage, storageOperationTimeout(&config)}},
+		bankDirectory:  bankDirectory,
+		sessionStarter: sessionStarter,
+		resultVerifier: resultVerifier,
+		rateLimiter:    rateLimiter,
+
+		checkIbanBackend: config.ReadinessCheckIbanBackend,
+	}
+
+	server, err := NewServer(serverState, config.ServerConfig)
 	if err != nil {
-		log.Error.Fatalf("failed to listen and serve: %v", err)
+		log.Fatal(ctx, "failed to create server", "error", err)
+	}
+
+	stopReloading := make(chan struct{})
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go reloadKeysOnSignal(jwtCreator, reloadSignals, stopReloading)
+
+	reloadInterval := defaultJwtKeyReloadInterval
+	if config.JwtKeyReloadIntervalMs > 0 {
+		reloadInterval = time.Duration(config.JwtKeyReloadIntervalMs) * time.Millisecond
+	}
+	go jwtCreator.WatchKeyFiles(reloadInterval, stopReloading)
+
+	err = serveUntilSignal(server, shutdownSignals())
+	close(stopReloading)
+	if closeErr := tokenStorage.Close(); closeErr != nil {
+		log.Error(ctx, "failed to close token storage", "error", closeErr)
+	}
+	if err != nil {
+		log.Fatal(ctx, "failed to listen and serve", "error", err)
+	}
+	log.Info(ctx, "server stopped")
+}
+
+// shutdownSignals returns the channel on which the signals that stop the server are delivered
+func shutdownSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return signals
+}
+
+// serveUntilSignal serves until the server fails or a signal is received,
+// in which case the server is stopped gracefully
+func serveUntilSignal(server *Server, signals <-chan os.Signal) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case sig := <-signals:
+		log.Info(context.Background(), "shutting down", "signal", sig.String())
+		err := server.Stop()
+		if err != nil {
+			return fmt.Errorf("failed to stop server gracefully: %w", err)
+		}
+		// ListenAndServe returns ErrServerClosed as soon as Stop is called
+		if err := <-serverErr; err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+}
+
+// registerLogSecrets makes sure the secrets from the config never end up in the logs
+func registerLogSecrets(config *Config) {
+	log.RegisterSecret(string(config.CmIbanConfig.MerchantToken))
+	log.RegisterSecret(config.IrmaRequestorToken)
+	log.RegisterSecret(config.RedisConfig.Password)
+	log.RegisterSecret(config.RedisSentinelConfig.Password)
+}
+
+// reloadKeysOnSignal reloads the jwt signing keys on every signal, until stop is closed
+func reloadKeysOnSignal(jwtCreator *DefaultJwtCreator, signals <-chan os.Signal, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-signals:
+			log.Info(context.Background(), "reloading jwt signing keys", "signal", sig.String())
+			err := jwtCreator.Reload()
+			if err != nil {
+				log.Error(context.Background(), "failed to reload jwt signing keys", "error", err)
+			}
+		}
 	}
 }
 
 func createTokenStorage(config *Config) (TokenStorage, error) {
+	ttl := Timeout
+	if config.StorageTtlMs > 0 {
+		ttl = time.Duration(config.StorageTtlMs) * time.Millisecond
+	}
+	cleanupInterval := CleanupInterval
+	if config.StorageCleanupIntervalMs > 0 {
+		cleanupInterval = time.Duration(config.StorageCleanupIntervalMs) * time.Millisecond
+	}
+
 	if config.StorageType == "redis" {
-		log.Info.Printf("Using redis token storage")
+		log.Info(context.Background(), "Using redis token storage")
 		client, err := NewRedisClient(&config.RedisConfig)
 		if err != nil {
 			return nil, err
 		}
-		return NewRedisTokenStorage(client, "iban-issuer"), nil
+		return NewRedisTokenStorage(client, "iban-issuer", ttl), nil
 	}
 	if config.StorageType == "redis_sentinel" {
-		log.Info.Printf("Using redis sentinal storage")
+		log.Info(context.Background(), "Using redis sentinal storage")
 		client, err := NewRedisSentinelClient(&config.RedisSentinelConfig)
 		if err != nil {
 			return nil, err
 		}
-		return NewRedisTokenStorage(client, config.RedisSentinelConfig.SentinelUsername), nil
+		return NewRedisTokenStorage(client, config.RedisSentinelConfig.SentinelUsername, ttl), nil
 	}
 	if config.StorageType == "memory" {
-		log.Info.Printf("Using in memory storage")
-		return NewInMemoryTokenStorage(), nil
+		log.Info(context.Background(), "Using in memory storage")
+		return NewInMemoryTokenStorage(ttl, cleanupInterval), nil
 	}
 	return nil, fmt.Errorf("%v is not a valid storage type", config.StorageType)
 }
 
+func storageOperationTimeout(config *Config) time.Duration {
+	if config.StorageOperationTimeoutMs > 0 {
+		return time.Duration(config.StorageOperationTimeoutMs) * time.Millisecond
+	}
+	return defaultStorageOperationTimeout
+}
+
+// createRateLimiter returns nil when no limits are configured. When the token storage
+// uses redis, the buckets are kept in redis as well, so the limits hold across replicas.
+func createRateLimiter(config *Config, tokenStorage TokenStorage) (*RateLimiter, error) {
+	if config.RateLimitConfig.PerIpRate <= 0 && config.RateLimitConfig.GlobalRate <= 0 {
+		return nil, nil
+	}
+	if redisStorage, ok := tokenStorage.(*RedisTokenStorage); ok {
+		log.Info(context.Background(), "Using redis rate limiting")
+		return NewRateLimiter(config.RateLimitConfig, NewRedisTokenBuckets(redisStorage.client, redisStorage.username))
+	}
+	log.Info(context.Background(), "Using in memory rate limiting")
+	return NewRateLimiter(config.RateLimitConfig, NewInMemoryTokenBuckets())
+}
+
 func createIbanBackend(config *Config) (IbanChecker, error) {
-	return NewCmIbanChecker(config.CmIbanConfig)
+	if config.IbanBackend == "" || config.IbanBackend == "cm" {
+		log.Info(context.Background(), "Using CM iban backend")
+		return NewCmIbanChecker(config.CmIbanConfig)
+	}
+	if config.IbanBackend == "mock" {
+		if !config.AllowInsecureMock {
+			return nil, fmt.Errorf("the mock iban backend issues unverified accounts and requires allow_insecure_mock")
+		}
+		log.Warn(context.Background(), "Using mock iban backend, anyone can choose the name and iban that are issued. "+
+			"Never use it with a production IRMA requestor key.")
+		return NewMockIbanChecker(config.MockIbanConfig)
+	}
+	return nil, fmt.Errorf("%v is not a valid iban backend", config.IbanBackend)
+}
+
+func createBankDirectory(config *Config) (*bankdir.Directory, error) {
+	if config.BankDirectoryPath == "" {
+		log.Info(context.Background(), "Using embedded bank directory")
+		return bankdir.Embedded()
+	}
+	log.Info(context.Background(), "Using bank directory", "path", config.BankDirectoryPath)
+	return bankdir.Load(config.BankDirectoryPath)
+}
+
+// createSessionStarter returns nil when the frontend should start the session itself
+func createSessionStarter(config *Config, jwtCreator JwtCreator) (IrmaSessionStarter, error) {
+	if config.SessionMode == "" || config.SessionMode == SessionModeClient {
+		log.Info(context.Background(), "Using client side session start")
+		return nil, nil
+	}
+	if config.SessionMode == SessionModeServer {
+		log.Info(context.Background(), "Using server side session start")
+		return NewIrmaSessionClient(config.IrmaServerUrl, config.IrmaRequestorToken, config.credentialConfigs(), config.IrmaCallbackUrl, jwtCreator), nil
+	}
+	return nil, fmt.Errorf("%v is not a valid session mode", config.SessionMode)
+}
+
+// createResultVerifier returns nil when no issuance session results should be received
+func createResultVerifier(config *Config) (*IrmaResultVerifier, error) {
+	if config.IrmaCallbackUrl == "" {
+		return nil, nil
+	}
+	if config.IrmaServerPublicKeyPath == "" {
+		return nil, fmt.Errorf("irma_server_public_key_path is required when irma_callback_url is set")
+	}
+	log.Info(context.Background(), "Receiving issuance session results", "callback_url", config.IrmaCallbackUrl)
+	return NewIrmaResultVerifier(config.IrmaServerPublicKeyPath)
 }
 
 func readConfigFile(path string) (Config, error) {
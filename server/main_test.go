@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blockingIbanChecker starts an iban check only once it's released
+type blockingIbanChecker struct {
+	stubIbanChecker
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingIbanChecker) StartIbanCheck(ctx context.Context, entranceCode string, language string) (*IdealTransaction, error) {
+	close(c.entered)
+	<-c.release
+	return c.stubIbanChecker.StartIbanCheck(ctx, entranceCode, language)
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func healthStatus(url string) int {
+	resp, err := http.Get(url + "/api/health")
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitForHealth polls the health check until it returns the status
+func waitForHealth(t *testing.T, url string, status int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if healthStatus(url) == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("health check didn't return %v in time", status)
+}
+
+// waitForListenerClosed waits until new connections to the port are refused
+func waitForListenerClosed(t *testing.T, port int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("listener wasn't closed in time")
+}
+
+func TestServeUntilSignalDrainsRequests(t *testing.T) {
+	checker := &blockingIbanChecker{
+		stubIbanChecker: stubIbanChecker{transaction: &IdealTransaction{TransactionID: "trx", MerchantReference: "ref"}},
+		entered:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	port := freePort(t)
+	server, err := NewServer(&ServerState{
+		ibanChecker:  checker,
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: newTestTokenStorage(t),
+	}, ServerConfig{
+		Host:            "127.0.0.1",
+		Port:            port,
+		StaticPath:      t.TempDir(),
+		ShutdownDelayMs: 500,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%v", port)
+
+	signals := shutdownSignals()
+	t.Cleanup(func() { signal.Stop(signals) })
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilSignal(server, signals)
+	}()
+	waitForHealth(t, url, http.StatusOK)
+
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(url+"/api/ibancheck", "application/json", strings.NewReader(`{"language": "en"}`))
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			inFlight <- nil
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp
+	}()
+	<-checker.entered
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatalf("failed to send signal: %v", err)
+	}
+	waitForHealth(t, url, http.StatusServiceUnavailable)
+	// Only let the request finish once new connections are refused, so it's really drained by the shutdown
+	waitForListenerClosed(t, port)
+	close(checker.release)
+
+	if resp := <-inFlight; resp != nil && resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request should complete, got %v", resp.StatusCode)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveUntilSignal should return nil after a graceful stop, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveUntilSignal didn't return after the signal")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "iban_issuer"
+
+var (
+	ibanChecksStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ideal_checks_started_total",
+		Help:      "Number of iDEAL transactions started.",
+	})
+	statusResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "status_results_total",
+		Help:      "Number of transaction statuses received from the iDEAL provider, per status.",
+	}, []string{"status"})
+	jwtsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jwts_created_total",
+		Help:      "Number of signed issuance requests created.",
+	})
+	issuanceResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "issuance_results_total",
+		Help:      "Number of issuance session results posted by the IRMA server, per status.",
+	}, []string{"status"})
+	tokenStorageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_storage_errors_total",
+		Help:      "Number of failed token storage operations, per operation.",
+	}, []string{"op"})
+	cmRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cm_request_duration_seconds",
+		Help:      "Duration of the calls to CM, per endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	cmRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cm_retries_total",
+		Help:      "Number of retried calls to CM, per endpoint.",
+	}, []string{"endpoint"})
+	cmCircuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cm_circuit_open",
+		Help:      "Whether the circuit breaker in front of CM is open (1) or closed (0).",
+	})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the http requests, per route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// routeTemplate returns the path template of the matched route, so ids in the path don't end up in labels
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+// metricsMiddleware records the duration of every request under the path template of its route
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		httpRequestDuration.
+			WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// countStorageErr counts the error when the storage backend failed,
+// errors like a missing transaction are part of the normal flow
+func countStorageErr(err error) {
+	var storageErr *TokenStorageError
+	if errors.As(err, &storageErr) {
+		tokenStorageErrors.WithLabelValues(storageErr.Op).Inc()
+	}
+}
+
+// instrumentedTokenStorage counts the errors of the wrapped TokenStorage
+type instrumentedTokenStorage struct {
+	TokenStorage
+}
+
+func (s instrumentedTokenStorage) StoreTransaction(ctx context.Context, record *TransactionRecord) error {
+	err := s.TokenStorage.StoreTransaction(ctx, record)
+	countStorageErr(err)
+	return err
+}
+
+func (s instrumentedTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	record, err := s.TokenStorage.RetrieveTransaction(ctx, transactionId)
+	countStorageErr(err)
+	return record, err
+}
+
+func (s instrumentedTokenStorage) UpdateTransaction(ctx context.Context, transactionId TransactonId, update func(record *TransactionRecord) error) (*TransactionRecord, error) {
+	record, err := s.TokenStorage.UpdateTransaction(ctx, transactionId, update)
+	countStorageErr(err)
+	return record, err
+}
+
+func (s instrumentedTokenStorage) ClaimTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	record, err := s.TokenStorage.ClaimTransaction(ctx, transactionId)
+	countStorageErr(err)
+	return record, err
+}
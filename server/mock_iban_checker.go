@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	log "yivi-iban-issuer/logging"
+
+	"github.com/google/uuid"
+)
+
+const MockBankPath = "/mock-bank/"
+
+// Outcomes posted here are scripted for the next transactions, e.g. by end-to-end tests
+const MockOutcomesPath = MockBankPath + "outcomes"
+
+type MockOutcome struct {
+	Status string `json:"status"`
+	Name   string `json:"name"`
+	IBAN   string `json:"iban"`
+	BIC    string `json:"bic"`
+}
+
+type MockIbanConfig struct {
+	// Base url under which this server is reachable, used to build the url of the fake bank page
+	BaseUrl string `json:"base_url"`
+	// Same format as the CM return url, the %s is replaced with the language
+	ReturnUrl string `json:"return_url"`
+	// Pre-fills the form on the bank page. Transactions for which no outcome was chosen
+	// or scripted report the status "open".
+	DefaultOutcome MockOutcome `json:"default_outcome"`
+	// Outcomes for the next transactions, taken in the order the transactions are started.
+	// These skip the bank page choice.
+	Outcomes []MockOutcome `json:"outcomes,omitempty"`
+	// Transactions that haven't finished within this time report the status "expired"
+	ExpiryMs int64 `json:"expiry_ms,omitempty"`
+}
+
+type mockTransaction struct {
+	IdealTransaction
+	language string
+	created  time.Time
+	outcome  *MockOutcome
+}
+
+// MockIbanChecker is an offline IbanChecker that doesn't talk to CM.
+// Instead it redirects the user to a fake bank page served by this process,
+// on which the outcome of the transaction can be chosen.
+type MockIbanChecker struct {
+	config       MockIbanConfig
+	transactions map[TransactonId]*mockTransaction
+	// Outcomes for the next transactions that are started, in order
+	scripted []MockOutcome
+	mutex    sync.Mutex
+}
+
+func NewMockIbanChecker(config MockIbanConfig) (*MockIbanChecker, error) {
+	if !strings.Contains(config.ReturnUrl, "%s") {
+		return nil, fmt.Errorf("mock return url should contain a %%s for the language: %v", config.ReturnUrl)
+	}
+	if config.DefaultOutcome.Status == "" {
+		config.DefaultOutcome.Status = "success"
+	}
+
+	return &MockIbanChecker{
+		config:       config,
+		transactions: make(map[TransactonId]*mockTransaction),
+		scripted:     slices.Clone(config.Outcomes),
+	}, nil
+}
+
+// QueueOutcome scripts the outcome of the next transaction that is started without a scripted
+// outcome yet, so the status can be controlled without visiting the bank page.
+func (m *MockIbanChecker) QueueOutcome(outcome MockOutcome) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.scripted = append(m.scripted, outcome)
+}
+
+func (m *MockIbanChecker) StartIbanCheck(ctx context.Context, entranceCode string, language string) (*IdealTransaction, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	transactionId := TransactonId(uuid.New().String())
+	trx := &mockTransaction{
+		IdealTransaction: IdealTransaction{
+			TransactionID:           transactionId,
+			EntranceCode:            entranceCode,
+			MerchantReference:       MerchantReference(uuid.New().String()),
+			IssuerAuthenticationURL: strings.TrimSuffix(m.config.BaseUrl, "/") + MockBankPath + string(transactionId),
+		},
+		language: language,
+		created:  time.Now(),
+	}
+	if len(m.scripted) > 0 {
+		outcome := m.scripted[0]
+		m.scripted = m.scripted[1:]
+		trx.outcome = &outcome
+	}
+	m.transactions[transactionId] = trx
+
+	log.Info(ctx, "Started mock IBAN check", "transaction_id", transactionId)
+	result := trx.IdealTransaction
+	return &result, nil
+}
+
+func (m *MockIbanChecker) GetStatus(ctx context.Context, merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	trx, ok := m.transactions[transactionId]
+	if !ok || trx.MerchantReference != merchantRef {
+		return nil, &IbanCheckerError{Op: "status", Err: fmt.Errorf("mock transaction %v not found", transactionId)}
+	}
+
+	status := &TransactionStatus{
+		TransactionID: transactionId,
+		Status:        "open",
+	}
+
+	if trx.outcome == nil {
+		if m.config.ExpiryMs > 0 && time.Since(trx.created) > time.Duration(m.config.ExpiryMs)*time.Millisecond {
+			status.Status = "expired"
+		}
+		return status, nil
+	}
+
+	status.Status = trx.outcome.Status
+	if status.Status == "success" {
+		status.Name = trx.outcome.Name
+		status.IBAN = trx.outcome.IBAN
+		status.IssuerID = trx.outcome.BIC
+	}
+	return status, nil
+}
+
+var mockBankTemplate = template.Must(template.New("bank").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock bank</title></head>
+<body>
+<h1>Mock bank</h1>
+<p>Transaction {{.TransactionID}}</p>
+<form method="POST">
+<p><label>Name <input name="name" value="{{.Outcome.Name}}"></label></p>
+<p><label>IBAN <input name="iban" value="{{.Outcome.IBAN}}"></label></p>
+<p><label>BIC <input name="bic" value="{{.Outcome.BIC}}"></label></p>
+{{range .Statuses}}<button type="submit" name="status" value="{{.}}">{{.}}</button>
+{{end}}</form>
+</body>
+</html>
+`))
+
+var mockStatuses = []string{"success", "failure", "cancelled", "open", "expired"}
+
+// ServeHTTP serves the fake bank page. A GET shows a form to choose the outcome,
+// a POST records it and redirects the user back to the return url.
+// A POST of an outcome in json to MockOutcomesPath queues it for the next transaction.
+func (m *MockIbanChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == MockOutcomesPath {
+		m.serveQueueOutcome(w, r)
+		return
+	}
+
+	transactionId := TransactonId(strings.TrimPrefix(r.URL.Path, MockBankPath))
+
+	m.mutex.Lock()
+	trx, ok := m.transactions[transactionId]
+	m.mutex.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err := mockBankTemplate.Execute(w, map[string]any{
+			"TransactionID": transactionId,
+			"Outcome":       m.config.DefaultOutcome,
+			"Statuses":      mockStatuses,
+		})
+		if err != nil {
+			log.Error(r.Context(), "failed to render mock bank page", "error", err)
+		}
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		outcome := MockOutcome{
+			Status: r.PostForm.Get("status"),
+			Name:   r.PostForm.Get("name"),
+			IBAN:   r.PostForm.Get("iban"),
+			BIC:    r.PostForm.Get("bic"),
+		}
+
+		m.mutex.Lock()
+		trx.outcome = &outcome
+		m.mutex.Unlock()
+
+		returnUrl := formatReturnUrl(m.config.ReturnUrl, trx.language)
+		query := url.Values{}
+		query.Set("trxid", string(transactionId))
+		query.Set("ec", trx.EntranceCode)
+		http.Redirect(w, r, returnUrl+"?"+query.Encode(), http.StatusSeeOther)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *MockIbanChecker) serveQueueOutcome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var outcome MockOutcome
+	err := json.NewDecoder(r.Body).Decode(&outcome)
+	if err != nil || !slices.Contains(mockStatuses, outcome.Status) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	m.QueueOutcome(outcome)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestMockIbanChecker(t *testing.T, outcomes ...MockOutcome) *MockIbanChecker {
+	t.Helper()
+	checker, err := NewMockIbanChecker(MockIbanConfig{
+		BaseUrl:   "http://localhost:8080",
+		ReturnUrl: "http://localhost:8080/%s/return",
+		Outcomes:  outcomes,
+	})
+	if err != nil {
+		t.Fatalf("failed to create mock iban checker: %v", err)
+	}
+	return checker
+}
+
+func mockStatus(t *testing.T, checker *MockIbanChecker, trx *IdealTransaction) *TransactionStatus {
+	t.Helper()
+	status, err := checker.GetStatus(context.Background(), trx.MerchantReference, trx.TransactionID)
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	return status
+}
+
+func TestMockConfiguredOutcomesAreTakenInOrder(t *testing.T) {
+	checker := newTestMockIbanChecker(t,
+		MockOutcome{Status: "success", Name: "J. Doe", IBAN: "NL91ABNA0417164300", BIC: "ABNANL2A"},
+		MockOutcome{Status: "cancelled"},
+	)
+
+	first, _ := checker.StartIbanCheck(context.Background(), "ec1", "en")
+	second, _ := checker.StartIbanCheck(context.Background(), "ec2", "en")
+	third, _ := checker.StartIbanCheck(context.Background(), "ec3", "en")
+
+	status := mockStatus(t, checker, first)
+	if status.Status != "success" || status.IBAN != "NL91ABNA0417164300" || status.Name != "J. Doe" {
+		t.Errorf("first transaction should get the first outcome, got %+v", status)
+	}
+	if status := mockStatus(t, checker, second); status.Status != "cancelled" {
+		t.Errorf("second transaction should get the second outcome, got %v", status.Status)
+	}
+	if status := mockStatus(t, checker, third); status.Status != "open" {
+		t.Errorf("transaction without scripted outcome should be open, got %v", status.Status)
+	}
+}
+
+func TestMockOutcomeQueuedOverHttp(t *testing.T) {
+	checker := newTestMockIbanChecker(t)
+
+	req := httptest.NewRequest("POST", MockOutcomesPath, strings.NewReader(`{"status": "failure"}`))
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("queueing an outcome should succeed, got %v", w.Code)
+	}
+
+	trx, _ := checker.StartIbanCheck(context.Background(), "ec", "en")
+	if status := mockStatus(t, checker, trx); status.Status != "failure" {
+		t.Errorf("transaction should get the queued outcome, got %v", status.Status)
+	}
+}
+
+func TestMockQueueOutcomeRejectsUnknownStatus(t *testing.T) {
+	checker := newTestMockIbanChecker(t)
+
+	req := httptest.NewRequest("POST", MockOutcomesPath, strings.NewReader(`{"status": "paid"}`))
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown status should be rejected, got %v", w.Code)
+	}
+}
+
+func TestMockBackendRequiresOptIn(t *testing.T) {
+	config := &Config{
+		IbanBackend:    "mock",
+		MockIbanConfig: MockIbanConfig{BaseUrl: "http://localhost:8080", ReturnUrl: "http://localhost:8080/%s/return"},
+	}
+	if _, err := createIbanBackend(config); err == nil {
+		t.Error("mock backend shouldn't start without allow_insecure_mock")
+	}
+
+	config.AllowInsecureMock = true
+	if _, err := createIbanBackend(config); err != nil {
+		t.Errorf("mock backend should start when it's allowed: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	log "yivi-iban-issuer/logging"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RateLimitConfig struct {
+	// Sustained number of requests per second and burst size per client ip, 0 disables the limit
+	PerIpRate  float64 `json:"per_ip_rate,omitempty"`
+	PerIpBurst int     `json:"per_ip_burst,omitempty"`
+	// Sustained number of requests per second and burst size for all clients together, 0 disables the limit
+	GlobalRate  float64 `json:"global_rate,omitempty"`
+	GlobalBurst int     `json:"global_burst,omitempty"`
+	// Ips or CIDRs of the proxies of which the X-Forwarded-For header is trusted
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+// TokenBuckets takes tokens from named token buckets, which refill at the given rate up to the burst size
+type TokenBuckets interface {
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, error)
+}
+
+// RateLimiter limits requests per client ip and globally
+type RateLimiter struct {
+	config         RateLimitConfig
+	buckets        TokenBuckets
+	trustedProxies []*net.IPNet
+}
+
+func NewRateLimiter(config RateLimitConfig, buckets TokenBuckets) (*RateLimiter, error) {
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		config:         config,
+		buckets:        buckets,
+		trustedProxies: trustedProxies,
+	}, nil
+}
+
+// parseTrustedProxies parses the ips and CIDRs, where a single ip is a network of one address
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	trustedProxies := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %v: %w", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return trustedProxies, nil
+}
+
+// Allow reports whether the request is within the limits. When the buckets
+// can't be reached the request is allowed, so an outage doesn't block all users.
+// The per ip limit is checked first, so a client that exceeds it can't drain the global limit.
+func (l *RateLimiter) Allow(r *http.Request) bool {
+	if l.config.PerIpRate > 0 && !l.take(r.Context(), "ip:"+l.clientIp(r), l.config.PerIpRate, l.config.PerIpBurst) {
+		return false
+	}
+	if l.config.GlobalRate > 0 && !l.take(r.Context(), "global", l.config.GlobalRate, l.config.GlobalBurst) {
+		return false
+	}
+	return true
+}
+
+func (l *RateLimiter) take(ctx context.Context, key string, rate float64, burst int) bool {
+	allowed, err := l.buckets.Take(ctx, key, rate, max(burst, 1))
+	if err != nil {
+		log.Error(ctx, "failed to check rate limit", "bucket", key, "error", err)
+		return true
+	}
+	return allowed
+}
+
+func (l *RateLimiter) isTrustedProxy(ip net.IP) bool {
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp returns the ip of the client, which is the remote address unless that is a trusted proxy.
+// In that case the X-Forwarded-For header is walked from the right, skipping the trusted proxies.
+func (l *RateLimiter) clientIp(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !l.isTrustedProxy(ip) {
+		return remote
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(forwarded[i])
+		candidateIp := net.ParseIP(candidate)
+		if candidateIp == nil {
+			break
+		}
+		if !l.isTrustedProxy(candidateIp) {
+			return candidate
+		}
+		remote = candidate
+	}
+	return remote
+}
+
+// rateLimited responds with a 429 to requests that exceed the limits
+func rateLimited(limiter *RateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter != nil && !limiter.Allow(r) {
+			respondWithErr(w, r, http.StatusTooManyRequests, ErrorRateLimit, "too many requests", fmt.Errorf("rate limit exceeded for %v", r.URL.Path))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ------------------------------------------------------------------------------
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// full reports whether the bucket has refilled completely, after which it behaves the same as a new bucket
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst)
+}
+
+// Number of buckets below which full buckets aren't evicted
+const minTokenBucketSweep = 1024
+
+// InMemoryTokenBuckets keeps the buckets in this process, so the limits hold per replica
+type InMemoryTokenBuckets struct {
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+	now     func() time.Time
+	// Number of buckets at which the full buckets are evicted next
+	sweepAt int
+}
+
+func NewInMemoryTokenBuckets() *InMemoryTokenBuckets {
+	return &InMemoryTokenBuckets{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+		sweepAt: minTokenBucketSweep,
+	}
+}
+
+func (b *InMemoryTokenBuckets) Take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= b.sweepAt {
+			b.evictFull(now)
+			// The next sweep waits until the map doubled, so many new clients at once
+			// cost amortized constant time instead of a sweep for every new bucket
+			b.sweepAt = max(minTokenBucketSweep, 2*len(b.buckets))
+		}
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.rate = rate
+	bucket.burst = burst
+
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+	return true, nil
+}
+
+// evictFull removes the buckets that are full again, because those behave the same as new buckets.
+// Only done when a bucket is added and the map reached sweepAt, so the map only holds the buckets
+// that are still refilling. Every bucket is checked against its own rate and burst, because the
+// global and per ip buckets share the map.
+func (b *InMemoryTokenBuckets) evictFull(now time.Time) {
+	for key, bucket := range b.buckets {
+		if bucket.full(now) {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------
+
+// Refills and takes from the bucket in one go, so concurrent replicas share the same bucket.
+// The bucket expires once it would be full again.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// RedisTokenBuckets keeps the buckets in redis, so the limits hold across replicas
+type RedisTokenBuckets struct {
+	client   *redis.Client
+	username string
+}
+
+func NewRedisTokenBuckets(client *redis.Client, username string) *RedisTokenBuckets {
+	return &RedisTokenBuckets{client: client, username: username}
+}
+
+func (b *RedisTokenBuckets) Take(ctx context.Context, key string, rate float64, burst int) (bool, error) {
+	keys := []string{fmt.Sprintf("%v:ratelimit:%v", b.username, key)}
+	now := time.Now().UnixMilli()
+
+	allowed, err := takeTokenScript.Run(ctx, b.client, keys, rate, burst, now).Int()
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
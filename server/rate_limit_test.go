@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newClockedTokenBuckets() (*InMemoryTokenBuckets, *testClock) {
+	clock := newTestClock()
+	buckets := NewInMemoryTokenBuckets()
+	buckets.now = clock.Now
+	return buckets, clock
+}
+
+func take(t *testing.T, buckets *InMemoryTokenBuckets, key string, rate float64, burst int) bool {
+	t.Helper()
+	allowed, err := buckets.Take(context.Background(), key, rate, burst)
+	if err != nil {
+		t.Fatalf("failed to take token: %v", err)
+	}
+	return allowed
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	buckets, clock := newClockedTokenBuckets()
+
+	for i := range 2 {
+		if !take(t, buckets, "key", 1, 2) {
+			t.Fatalf("token %v of the burst should be allowed", i+1)
+		}
+	}
+	if take(t, buckets, "key", 1, 2) {
+		t.Fatal("empty bucket shouldn't allow a token")
+	}
+
+	clock.Advance(time.Second)
+	if !take(t, buckets, "key", 1, 2) {
+		t.Error("bucket should refill at the rate")
+	}
+	if take(t, buckets, "key", 1, 2) {
+		t.Error("bucket should only refill one token per second")
+	}
+}
+
+func TestTokenBucketEvictionUsesOwnRate(t *testing.T) {
+	buckets, clock := newClockedTokenBuckets()
+	// Sweep whenever a bucket is added
+	buckets.sweepAt = 1
+
+	// A slowly refilling global bucket, emptied
+	for range 2 {
+		take(t, buckets, "global", 0.1, 2)
+	}
+	// Long enough for a fast per ip bucket to refill, not for the global bucket
+	clock.Advance(3 * time.Second)
+	take(t, buckets, "ip:1", 1, 2)
+
+	if _, ok := buckets.buckets["global"]; !ok {
+		t.Fatal("global bucket that isn't full shouldn't be evicted")
+	}
+	if take(t, buckets, "global", 0.1, 2) {
+		t.Error("global bucket shouldn't be refilled by the eviction")
+	}
+}
+
+func TestTokenBucketEvictsFullBucketsOnceMapIsLarge(t *testing.T) {
+	buckets, clock := newClockedTokenBuckets()
+
+	for i := range minTokenBucketSweep {
+		take(t, buckets, fmt.Sprintf("ip:%v", i), 1, 2)
+	}
+	if len(buckets.buckets) != minTokenBucketSweep {
+		t.Fatalf("buckets shouldn't be evicted below the sweep size, got %v", len(buckets.buckets))
+	}
+
+	clock.Advance(time.Second)
+	take(t, buckets, "ip:new", 1, 2)
+	if len(buckets.buckets) != 1 {
+		t.Errorf("full buckets should be evicted once the sweep size is reached, got %v", len(buckets.buckets))
+	}
+}
+
+func TestTokenBucketSweepsAreAmortized(t *testing.T) {
+	buckets, _ := newClockedTokenBuckets()
+
+	// Buckets of clients that keep sending never refill, so a sweep can't evict them
+	for i := range minTokenBucketSweep + 1 {
+		take(t, buckets, fmt.Sprintf("ip:%v", i), 0.001, 1)
+	}
+	if buckets.sweepAt != 2*minTokenBucketSweep {
+		t.Errorf("next sweep should wait until the map doubled, got %v", buckets.sweepAt)
+	}
+}
+
+func TestRateLimiterRejectedClientDoesNotDrainGlobalLimit(t *testing.T) {
+	buckets, _ := newClockedTokenBuckets()
+	limiter, err := NewRateLimiter(RateLimitConfig{
+		PerIpRate:   0.001,
+		PerIpBurst:  1,
+		GlobalRate:  0.001,
+		GlobalBurst: 3,
+	}, buckets)
+	if err != nil {
+		t.Fatalf("failed to create rate limiter: %v", err)
+	}
+
+	request := func(ip string) bool {
+		r := httptest.NewRequest("POST", "/api/ibancheck", nil)
+		r.RemoteAddr = ip + ":1234"
+		return limiter.Allow(r)
+	}
+
+	if !request("192.0.2.1") {
+		t.Fatal("first request of a client should be allowed")
+	}
+	for range 10 {
+		if request("192.0.2.1") {
+			t.Fatal("client over its limit should be rejected")
+		}
+	}
+	if !request("192.0.2.2") || !request("192.0.2.3") {
+		t.Error("other clients should still be within the global limit")
+	}
+	if request("192.0.2.4") {
+		t.Error("global limit should hold")
+	}
+}
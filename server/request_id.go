@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	log "yivi-iban-issuer/logging"
+
+	"github.com/google/uuid"
+)
+
+// Header with which the request id is received from the client and passed on to CM
+const RequestIdHeader = "X-Request-ID"
+
+// Longer incoming request ids are replaced, so clients can't flood the logs
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// requestIdFrom returns the id of the request the context belongs to, or an empty string
+func requestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range requestId {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIdMiddleware accepts the request id of the client or creates one, stores it in the
+// request context and logs and returns it, so a request can be followed through the logs and CM
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId = uuid.New().String()
+		}
+
+		ctx := context.WithValue(r.Context(), requestIdKey{}, requestId)
+		ctx = log.WithAttrs(ctx, "request_id", requestId)
+		w.Header().Set(RequestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -4,23 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync/atomic"
 	"time"
+	"yivi-iban-issuer/bankdir"
+	"yivi-iban-issuer/iban"
 	log "yivi-iban-issuer/logging"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	irma "github.com/privacybydesign/irmago"
 )
 
-const ErrorPhoneNumberFormat = "error:phone-number-format"
-const ErrorRateLimit = "error:ratelimit"
-const ErrorCannotValidateToken = "error:cannot-validate-token"
-const ErrorAddressMalformed = "error:address-malformed"
-const ErrorInternal = "error:internal"
-const ErrorSendingSms = "error:sending-sms"
-
 type ServerConfig struct {
 	Host           string `json:"host"`
 	Port           int    `json:"port"`
@@ -28,13 +27,33 @@ type ServerConfig struct {
 	UseTls         bool   `json:"use_tls,omitempty"`
 	TlsPrivKeyPath string `json:"tls_priv_key_path,omitempty"`
 	TlsCertPath    string `json:"tls_cert_path,omitempty"`
+	// When set, /metrics is served on this separate address instead of on the main router
+	MetricsAddress string `json:"metrics_address,omitempty"`
+	// Time between failing the health check and closing the listener on shutdown,
+	// so the load balancer can stop sending new requests. Defaults to 0.
+	ShutdownDelayMs int64 `json:"shutdown_delay_ms,omitempty"`
+	// Time in-flight requests get to finish on shutdown. Defaults to 10 seconds.
+	ShutdownGracePeriodMs int64 `json:"shutdown_grace_period_ms,omitempty"`
 }
 
+const defaultShutdownGracePeriod = 10 * time.Second
+
 type ServerState struct {
 	irmaServerURL string
 	ibanChecker   IbanChecker
 	jwtCreator    JwtCreator
 	tokenStorage  TokenStorage
+	bankDirectory *bankdir.Directory
+	// only set when the backend starts the issuance session itself
+	sessionStarter IrmaSessionStarter
+	// only set when the IRMA server posts issuance results to this server
+	resultVerifier *IrmaResultVerifier
+	// only set when requests to start an iban check are rate limited
+	rateLimiter *RateLimiter
+	// whether the readiness check includes the reachability of the iban backend
+	checkIbanBackend bool
+	// set when the server is shutting down, so the health check starts failing
+	shuttingDown atomic.Bool
 }
 
 type spaHandler struct {
@@ -43,11 +62,24 @@ type spaHandler struct {
 }
 
 type Server struct {
-	server *http.Server
-	config ServerConfig
+	server        *http.Server
+	metricsServer *http.Server
+	config        ServerConfig
+	state         *ServerState
+	// Cancels the contexts of the requests that are still running after the grace period
+	cancelRequests context.CancelFunc
 }
 
 func (s *Server) ListenAndServe() error {
+	if s.metricsServer != nil {
+		go func() {
+			err := s.metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Error(context.Background(), "failed to listen and serve metrics", "error", err)
+			}
+		}()
+	}
+
 	if s.config.UseTls {
 		return s.server.ListenAndServeTLS(s.config.TlsCertPath, s.config.TlsPrivKeyPath)
 	} else {
@@ -55,10 +87,28 @@ func (s *Server) ListenAndServe() error {
 	}
 }
 
+// Stop marks the server as not ready, waits for the shutdown delay and then
+// stops accepting connections, while giving in-flight requests the grace period to finish
 func (s *Server) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	s.state.shuttingDown.Store(true)
+	time.Sleep(time.Duration(s.config.ShutdownDelayMs) * time.Millisecond)
+
+	gracePeriod := defaultShutdownGracePeriod
+	if s.config.ShutdownGracePeriodMs > 0 {
+		gracePeriod = time.Duration(s.config.ShutdownGracePeriodMs) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
 	defer cancel()
-	return s.server.Shutdown(ctx)
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			log.Error(context.Background(), "failed to stop metrics server", "error", err)
+		}
+	}
+	err := s.server.Shutdown(ctx)
+	// Aborts the outstanding storage and CM calls of the requests that didn't finish in time
+	s.cancelRequests()
+	return err
 }
 
 // ServeHTTP inspects the URL path to locate a file within the static dir
@@ -90,39 +140,92 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func NewServer(state *ServerState, config ServerConfig) (*Server, error) {
 	router := mux.NewRouter()
+	router.Use(requestIdMiddleware, metricsMiddleware, requestLoggingMiddleware)
+
+	readinessHandler := func(w http.ResponseWriter, r *http.Request) {
+		handleReadiness(state, w, r)
+	}
+
+	// The readiness check calls the dependencies, so with a separate metrics listener
+	// it's only served there instead of to anyone who can reach the api
+	var metricsServer *http.Server
+	if config.MetricsAddress == "" {
+		router.Handle("/metrics", metricsHandler())
+		router.HandleFunc("/api/health/ready", readinessHandler)
+	} else {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", metricsHandler())
+		metricsRouter.HandleFunc("/api/health/ready", readinessHandler)
+		metricsServer = &http.Server{
+			Handler:      metricsRouter,
+			Addr:         config.MetricsAddress,
+			WriteTimeout: 15 * time.Second,
+			ReadTimeout:  15 * time.Second,
+		}
+	}
 
 	router.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		err := json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+		ok := !state.shuttingDown.Load()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(map[string]bool{"ok": ok})
 		if err != nil {
-			log.Error.Fatalf("failed to write body to http response: %v", err)
+			log.Error(r.Context(), "failed to write body to http response", "error", err)
 		}
 	})
+	router.HandleFunc("/api/health/live", handleLiveness)
 
-	router.HandleFunc("/api/ibancheck", func(w http.ResponseWriter, r *http.Request) {
+	// every iban check starts a paid iDEAL transaction, so these are rate limited
+	router.HandleFunc("/api/ibancheck", rateLimited(state.rateLimiter, func(w http.ResponseWriter, r *http.Request) {
 		handleIBANCheck(state, w, r)
-	})
+	}))
 	router.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
 		handleGetIBANStatus(state, w, r)
 	})
 
+	if state.resultVerifier != nil {
+		router.HandleFunc(IrmaCallbackPath+"{transaction_id}/{secret}", func(w http.ResponseWriter, r *http.Request) {
+			handleIrmaCallback(state, w, r)
+		})
+	}
+
+	if mockBank, ok := state.ibanChecker.(*MockIbanChecker); ok {
+		router.PathPrefix(MockBankPath).Handler(mockBank)
+	}
+
 	spa := spaHandler{staticPath: config.StaticPath, indexPath: "index.html"}
 	router.PathPrefix("/").Handler(spa)
 
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+
 	addr := fmt.Sprintf("%v:%v", config.Host, config.Port)
 	srv := &http.Server{
-		Handler: router,
-		Addr:    addr,
+		Handler:     router,
+		Addr:        addr,
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
 	return &Server{
-		server: srv,
-		config: config,
+		server:        srv,
+		metricsServer: metricsServer,
+		config:        config,
+		state:         state,
+
+		cancelRequests: cancelRequests,
 	}, nil
 }
 
+// languages the frontend is translated in, the language ends up in the return url
+var supportedLanguages = []string{"en", "nl"}
+
+func isSupportedLanguage(language string) bool {
+	return slices.Contains(supportedLanguages, language)
+}
+
 type IBANCheckResponseMessage struct {
 	TransactionID           TransactonId `json:"transaction_id"`
 	IssuerAuthenticationURL string       `json:"issuer_authentication_url"`
@@ -132,7 +235,7 @@ func handleIBANCheck(state *ServerState, w http.ResponseWriter, r *http.Request)
 	defer r.Body.Close()
 
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		respondWithErr(w, r, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "method not allowed", fmt.Errorf("got %v", r.Method))
 		return
 	}
 
@@ -147,24 +250,49 @@ func handleIBANCheck(state *ServerState, w http.ResponseWriter, r *http.Request)
 	// Decode the JSON body
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
-		respondWithErr(w, http.StatusBadRequest, ErrorInternal, "failed to parse json for body of the request", err)
+		respondWithErr(w, r, http.StatusBadRequest, ErrorMalformedRequest, "failed to parse json for body of the request", err)
+		return
+	}
+
+	if !isSupportedLanguage(input.Language) {
+		respondWithErr(w, r, http.StatusBadRequest, ErrorInvalidLanguage, "unsupported language", fmt.Errorf("got %q", input.Language))
 		return
 	}
 
-	log.Info.Printf("Received IBAN check request with entrance code: %v", entranceCode)
-	ibanTransaction, err := state.ibanChecker.StartIbanCheck(entranceCode, input.Language)
+	log.Info(r.Context(), "Received IBAN check request", "entrance_code", entranceCode)
+	ibanTransaction, err := state.ibanChecker.StartIbanCheck(r.Context(), entranceCode, input.Language)
 	if err != nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to start iban check", err)
+		respondWithBackendErr(w, r, "failed to start iban check", err)
+		return
+	}
+	r = r.WithContext(log.WithAttrs(r.Context(), "transaction_id", ibanTransaction.TransactionID))
+	ibanChecksStarted.Inc()
+
+	sessionNonce, sessionBindingHash, err := newNonce()
+	if err != nil {
+		respondWithErr(w, r, http.StatusInternalServerError, ErrorInternal, "failed to create session binding", err)
 		return
 	}
 
 	// Add to transaction cache
-	log.Info.Printf("Adding to transaction cache: %v %v", ibanTransaction.TransactionID, ibanTransaction.MerchantReference)
-	err = state.tokenStorage.StoreToken(ibanTransaction.TransactionID, ibanTransaction.MerchantReference)
+	log.Info(r.Context(), "Adding to transaction cache")
+	now := time.Now()
+	err = state.tokenStorage.StoreTransaction(r.Context(), &TransactionRecord{
+		TransactionID:      ibanTransaction.TransactionID,
+		MerchantReference:  ibanTransaction.MerchantReference,
+		EntranceCode:       entranceCode,
+		Language:           input.Language,
+		SessionBindingHash: sessionBindingHash,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		State:              TransactionStarted,
+	})
 	if err != nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to store token in cache", err)
+		respondWithBackendErr(w, r, "failed to store transaction in cache", err)
 		return
 	}
+	setSessionCookie(w, sessionNonce)
+
 	responseMessage := IBANCheckResponseMessage{
 		TransactionID:           ibanTransaction.TransactionID,
 		IssuerAuthenticationURL: ibanTransaction.IssuerAuthenticationURL,
@@ -172,22 +300,26 @@ func handleIBANCheck(state *ServerState, w http.ResponseWriter, r *http.Request)
 
 	payload, err := json.Marshal(responseMessage)
 	if err != nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to marshal response message", err)
+		respondWithErr(w, r, http.StatusInternalServerError, ErrorInternal, "failed to marshal response message", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(payload)
 	if err != nil {
-		log.Error.Fatalf("failed to write body to http response: %v", err)
+		log.Error(r.Context(), "failed to write body to http response", "error", err)
 	}
 }
 
 type IBANStatusResponseMessage struct {
 	TransactionStatus TransactionStatus `json:"transaction_status"`
-	Jwt               string            `json:"jwt"`
-	IrmaServerURL     string            `json:"irma_server_url"`
+	Jwt               string            `json:"jwt,omitempty"`
+	IrmaServerURL     string            `json:"irma_server_url,omitempty"`
+
+	// Set instead of the JWT when the session is started by the backend
+	SessionPtr      *irma.Qr                     `json:"session_ptr,omitempty"`
+	FrontendRequest *irma.FrontendSessionRequest `json:"frontend_request,omitempty"`
 }
 
 // handles a POST request to get the status of an IBAN check
@@ -197,7 +329,7 @@ func handleGetIBANStatus(state *ServerState, w http.ResponseWriter, r *http.Requ
 	defer r.Body.Close()
 
 	if r.Method != "POST" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		respondWithErr(w, r, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "method not allowed", fmt.Errorf("got %v", r.Method))
 		return
 	}
 
@@ -209,24 +341,49 @@ func handleGetIBANStatus(state *ServerState, w http.ResponseWriter, r *http.Requ
 	// Decode the JSON body
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
-		respondWithErr(w, http.StatusBadRequest, ErrorInternal, "failed to parse json for body of the request", err)
+		respondWithErr(w, r, http.StatusBadRequest, ErrorMalformedRequest, "failed to parse json for body of the request", err)
 		return
 	}
 
-	merchantRef, err := state.tokenStorage.RetrieveToken(input.TransactionID)
+	r = r.WithContext(log.WithAttrs(r.Context(), "transaction_id", input.TransactionID))
+
+	record, err := state.tokenStorage.RetrieveTransaction(r.Context(), input.TransactionID)
 	if err != nil {
-		respondWithErr(w, http.StatusBadRequest, ErrorInternal, "transaction not found", err)
+		respondWithBackendErr(w, r, "transaction not found", err)
 		return
 	}
 
-	transactionStatus, err := state.ibanChecker.GetStatus(merchantRef, input.TransactionID)
+	// The transaction id ends up in the return url, so it can't be trusted on its own
+	err = verifySessionBinding(r, record)
 	if err != nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to get iban status", err)
+		respondWithErr(w, r, http.StatusForbidden, ErrorSessionMismatch, "transaction belongs to another browser session", err)
 		return
 	}
 
+	// A final status that's already known is answered from storage,
+	// only a transaction that's still pending is polled at CM
+	transactionStatus := record.IdealStatus
 	if transactionStatus == nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "transaction status is nil", err)
+		transactionStatus, err = state.ibanChecker.GetStatus(r.Context(), record.MerchantReference, input.TransactionID)
+		if err != nil {
+			respondWithBackendErr(w, r, "failed to get iban status", err)
+			return
+		}
+
+		if transactionStatus == nil {
+			respondWithErr(w, r, http.StatusBadGateway, ErrorIbanProviderUnavailable, "transaction status is nil", err)
+			return
+		}
+		statusResults.WithLabelValues(transactionStatus.Status).Inc()
+	}
+
+	record, err = state.tokenStorage.UpdateTransaction(r.Context(), input.TransactionID, func(record *TransactionRecord) error {
+		record.StatusPolls++
+		record.setIdealStatus(transactionStatus)
+		return nil
+	})
+	if err != nil {
+		respondWithBackendErr(w, r, "failed to update transaction", err)
 		return
 	}
 
@@ -235,40 +392,157 @@ func handleGetIBANStatus(state *ServerState, w http.ResponseWriter, r *http.Requ
 	}
 
 	if transactionStatus.Status == "success" {
-		// Create JWT
-		IBANStatusResponseMessage.Jwt, err = state.jwtCreator.CreateJwt(transactionStatus.Name, transactionStatus.IBAN, transactionStatus.IssuerID)
-		IBANStatusResponseMessage.IrmaServerURL = state.irmaServerURL
+		// Never issue whatever the provider returned without checking it is an actual iban
+		normalizedIban, err := iban.Validate(transactionStatus.IBAN)
+		if err != nil {
+			respondWithErr(w, r, http.StatusBadGateway, ErrorInvalidIban, "iban provider returned an invalid iban", err)
+			return
+		}
+		// The status in the response is a copy, so normalizing it doesn't change the stored one
+		verified := &IBANStatusResponseMessage.TransactionStatus
+		verified.IBAN = normalizedIban
+
+		bic, bankName, err := resolveBank(r.Context(), state.bankDirectory, verified)
 		if err != nil {
-			respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to create jwt", err)
+			respondWithErr(w, r, http.StatusBadGateway, ErrorUnknownBank, "failed to determine the bic of the account", err)
 			return
 		}
-		// Remove from transaction cache
-		err = state.tokenStorage.RemoveToken(input.TransactionID)
+
+		// Claim the transaction before creating anything, so concurrent requests
+		// for the same transaction can't both receive a credential
+		_, err = state.tokenStorage.ClaimTransaction(r.Context(), input.TransactionID)
 		if err != nil {
-			respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to delete token from cache", err)
+			respondWithBackendErr(w, r, "failed to claim transaction for issuance", err)
+			return
+		}
+
+		account := IbanAccount{
+			Fullname: verified.Name,
+			Iban:     verified.IBAN,
+			Bic:      bic,
+			BankName: bankName,
+
+			IdealIssuerId: verified.IssuerID,
+			VerifiedAt:    time.Now(),
+		}
+
+		// Every issuance gets a new callback secret, so only the result of the latest session is accepted
+		callbackSecret, callbackHash, err := newNonce()
+		if err != nil {
+			releaseClaim(r.Context(), state, input.TransactionID)
+			respondWithErr(w, r, http.StatusInternalServerError, ErrorInternal, "failed to create callback secret", err)
+			return
+		}
+
+		var sessionToken irma.RequestorToken
+		if state.sessionStarter != nil {
+			sessionPackage, err := state.sessionStarter.StartIssuanceSession(r.Context(), input.TransactionID, callbackSecret, account)
+			if err != nil {
+				releaseClaim(r.Context(), state, input.TransactionID)
+				respondWithErr(w, r, http.StatusBadGateway, ErrorIrmaSession, "failed to start issuance session", err)
+				return
+			}
+			sessionToken = sessionPackage.Token
+			IBANStatusResponseMessage.SessionPtr = sessionPackage.SessionPtr
+			IBANStatusResponseMessage.FrontendRequest = sessionPackage.FrontendRequest
+		} else {
+			// Create JWT
+			IBANStatusResponseMessage.Jwt, err = state.jwtCreator.CreateJwt(input.TransactionID, callbackSecret, account)
+			IBANStatusResponseMessage.IrmaServerURL = state.irmaServerURL
+			if err != nil {
+				releaseClaim(r.Context(), state, input.TransactionID)
+				respondWithErr(w, r, http.StatusInternalServerError, ErrorJwtSigning, "failed to create jwt", err)
+				return
+			}
+		}
+
+		_, err = state.tokenStorage.UpdateTransaction(r.Context(), input.TransactionID, func(record *TransactionRecord) error {
+			record.IrmaSessionToken = sessionToken
+			record.IrmaCallbackHash = callbackHash
+			// The name and iban aren't kept once they're handed out, a retried issuance gets them from CM again
+			record.IdealStatus = nil
+			return nil
+		})
+		if err != nil {
+			releaseClaim(r.Context(), state, input.TransactionID)
+			respondWithBackendErr(w, r, "failed to store issuance session", err)
 			return
 		}
 	}
 
 	payload, err := json.Marshal(IBANStatusResponseMessage)
 	if err != nil {
-		respondWithErr(w, http.StatusInternalServerError, ErrorInternal, "failed to marshal response message", err)
+		respondWithErr(w, r, http.StatusInternalServerError, ErrorInternal, "failed to marshal response message", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(payload)
 	if err != nil {
-		log.Error.Fatalf("failed to write body to http response: %v", err)
+		log.Error(r.Context(), "failed to write body to http response", "error", err)
+	}
+}
+
+// releaseClaim undoes a claim on the transaction, so the issuance can be retried
+func releaseClaim(ctx context.Context, state *ServerState, transactionId TransactonId) {
+	// The claim should also be released when the client went away in the meantime
+	ctx = context.WithoutCancel(ctx)
+	_, err := state.tokenStorage.UpdateTransaction(ctx, transactionId, func(record *TransactionRecord) error {
+		record.JwtIssued = false
+		record.State = TransactionVerified
+		return nil
+	})
+	if err != nil {
+		log.Error(ctx, "failed to release claim on transaction", "error", err)
 	}
 }
 
-func respondWithErr(w http.ResponseWriter, code int, responseBody string, logMsg string, e error) {
-	m := fmt.Sprintf("%v: %v", logMsg, e)
-	log.Error.Fatalf("%s\n -> returning statuscode %d with message %v", m, code, responseBody)
+// requestLoggingMiddleware attaches the route of the request to all logs made while handling it
+func requestLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := log.WithAttrs(r.Context(), "method", r.Method, "route", routeTemplate(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// respondWithBackendErr responds with the status code and error code that belong
+// to an error returned by the IbanChecker or TokenStorage
+func respondWithBackendErr(w http.ResponseWriter, r *http.Request, logMsg string, e error) {
+	code, errorCode := errorResponse(e)
+	respondWithErr(w, r, code, errorCode, logMsg, e)
+}
+
+type ErrorResponseMessage struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// respondWithErr logs the error and responds with a JSON error envelope.
+// The log message is returned to the client, so it shouldn't contain sensitive information.
+func respondWithErr(w http.ResponseWriter, r *http.Request, code int, errorCode string, logMsg string, e error) {
+	requestId := requestIdFrom(r.Context())
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+
+	log.Error(r.Context(), logMsg, "error", e, "status", code, "error_code", errorCode)
+
+	payload, err := json.Marshal(ErrorResponseMessage{
+		Error:     errorCode,
+		Message:   logMsg,
+		RequestID: requestId,
+	})
+	if err != nil {
+		log.Error(r.Context(), "failed to marshal error response", "error", err)
+		w.WriteHeader(code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	if _, err := w.Write([]byte(responseBody)); err != nil {
-		log.Error.Fatalf("failed to write body to http response: %v", err)
+	if _, err := w.Write(payload); err != nil {
+		log.Error(r.Context(), "failed to write body to http response", "error", err)
 	}
 }
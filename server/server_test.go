@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"yivi-iban-issuer/bankdir"
+)
+
+// stubIbanChecker returns the configured transaction, status or error
+type stubIbanChecker struct {
+	transaction *IdealTransaction
+	status      *TransactionStatus
+	err         error
+}
+
+func (s *stubIbanChecker) StartIbanCheck(ctx context.Context, entranceCode string, language string) (*IdealTransaction, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.transaction, nil
+}
+
+func (s *stubIbanChecker) GetStatus(ctx context.Context, merchantRef MerchantReference, transactionId TransactonId) (*TransactionStatus, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.status, nil
+}
+
+// failingTokenStorage fails every operation with a TokenStorageError
+type failingTokenStorage struct {
+	*InMemoryTokenStorage
+}
+
+var errStorageDown = errors.New("storage is down")
+
+func (s failingTokenStorage) StoreTransaction(ctx context.Context, record *TransactionRecord) error {
+	return &TokenStorageError{Op: "store", Err: errStorageDown}
+}
+
+func (s failingTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	return nil, &TokenStorageError{Op: "retrieve", Err: errStorageDown}
+}
+
+func (s failingTokenStorage) Ping(ctx context.Context) error {
+	return &TokenStorageError{Op: "ping", Err: errStorageDown}
+}
+
+type stubJwtCreator struct{}
+
+func (stubJwtCreator) CreateJwt(transactionId TransactonId, callbackSecret string, account IbanAccount) (string, error) {
+	return "jwt-for-" + string(transactionId), nil
+}
+
+func (stubJwtCreator) Probe() error {
+	return nil
+}
+
+func newTestTokenStorage(t *testing.T) *InMemoryTokenStorage {
+	t.Helper()
+	storage := NewInMemoryTokenStorage(time.Hour, time.Hour)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func newTestServer(t *testing.T, state *ServerState) *httptest.Server {
+	t.Helper()
+	server, err := NewServer(state, ServerConfig{StaticPath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	testServer := httptest.NewServer(server.server.Handler)
+	t.Cleanup(testServer.Close)
+	return testServer
+}
+
+// postJson posts the body and returns the response, which is closed when the test ends
+func postJson(t *testing.T, url string, body string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request to %v failed: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func assertErrorResponse(t *testing.T, resp *http.Response, code int, errorCode string) {
+	t.Helper()
+	if resp.StatusCode != code {
+		t.Errorf("expected status %v, got %v", code, resp.StatusCode)
+	}
+	var envelope ErrorResponseMessage
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		t.Fatalf("response is not an error envelope: %v", err)
+	}
+	if envelope.Error != errorCode {
+		t.Errorf("expected error %v, got %v", errorCode, envelope.Error)
+	}
+	if envelope.RequestID == "" {
+		t.Error("error envelope should carry a request id")
+	}
+}
+
+func newTestBankDirectory(t *testing.T) *bankdir.Directory {
+	t.Helper()
+	directory, err := bankdir.Embedded()
+	if err != nil {
+		t.Fatalf("failed to load bank directory: %v", err)
+	}
+	return directory
+}
+
+// storeStartedTransaction stores a started transaction and returns the session cookie of the browser that started it
+func storeStartedTransaction(t *testing.T, storage TokenStorage, transactionId TransactonId) *http.Cookie {
+	t.Helper()
+	nonce, bindingHash, err := newNonce()
+	if err != nil {
+		t.Fatalf("failed to create session binding: %v", err)
+	}
+	err = storage.StoreTransaction(context.Background(), &TransactionRecord{
+		TransactionID:      transactionId,
+		MerchantReference:  "ref",
+		SessionBindingHash: bindingHash,
+		State:              TransactionStarted,
+	})
+	if err != nil {
+		t.Fatalf("failed to store transaction: %v", err)
+	}
+	return &http.Cookie{Name: SessionCookieName, Value: nonce}
+}
+
+// successStatus is the status of a transaction of which the bank verified the account
+func successStatus(transactionId TransactonId) *TransactionStatus {
+	return &TransactionStatus{
+		TransactionID: transactionId,
+		Status:        "success",
+		IssuerID:      "ABNANL2A",
+		Name:          "J. Doe",
+		IBAN:          "NL91ABNA0417164300",
+	}
+}
+
+// assertServing checks that the server still handles requests after an error
+func assertServing(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/health")
+	if err != nil {
+		t.Fatalf("server stopped serving: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health check should succeed, got %v", resp.StatusCode)
+	}
+}
+
+func TestMalformedJsonIsRejected(t *testing.T) {
+	server := newTestServer(t, &ServerState{
+		ibanChecker:  &stubIbanChecker{},
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: newTestTokenStorage(t),
+	})
+
+	for _, path := range []string{"/api/ibancheck", "/api/status"} {
+		t.Run(path, func(t *testing.T) {
+			resp := postJson(t, server.URL+path, `{"language": `)
+			assertErrorResponse(t, resp, http.StatusBadRequest, ErrorMalformedRequest)
+			assertServing(t, server)
+		})
+	}
+}
+
+func TestIbanCheckerErrorReturnsBadGateway(t *testing.T) {
+	server := newTestServer(t, &ServerState{
+		ibanChecker:  &stubIbanChecker{err: &IbanCheckerError{Op: "transaction", Err: errors.New("CM is down")}},
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: newTestTokenStorage(t),
+	})
+
+	resp := postJson(t, server.URL+"/api/ibancheck", `{"language": "en"}`)
+	assertErrorResponse(t, resp, http.StatusBadGateway, ErrorIbanProviderUnavailable)
+	assertServing(t, server)
+}
+
+func TestTokenStorageErrorReturnsServiceUnavailable(t *testing.T) {
+	server := newTestServer(t, &ServerState{
+		ibanChecker: &stubIbanChecker{transaction: &IdealTransaction{
+			TransactionID:     "trx",
+			MerchantReference: "ref",
+		}},
+		jwtCreator:   stubJwtCreator{},
+		tokenStorage: failingTokenStorage{newTestTokenStorage(t)},
+	})
+
+	resp := postJson(t, server.URL+"/api/ibancheck", `{"language": "en"}`)
+	assertErrorResponse(t, resp, http.StatusServiceUnavailable, ErrorStorageUnavailable)
+	assertServing(t, server)
+
+	resp = postJson(t, server.URL+"/api/status", `{"transaction_id": "trx"}`)
+	assertErrorResponse(t, resp, http.StatusServiceUnavailable, ErrorStorageUnavailable)
+	assertServing(t, server)
+}
+
+func TestConcurrentStatusRequestsIssueOnce(t *testing.T) {
+	const requests = 20
+
+	storage := newTestTokenStorage(t)
+	cookie := storeStartedTransaction(t, storage, "trx")
+
+	server := newTestServer(t, &ServerState{
+		ibanChecker:   &stubIbanChecker{status: successStatus("trx")},
+		jwtCreator:    stubJwtCreator{},
+		tokenStorage:  storage,
+		bankDirectory: newTestBankDirectory(t),
+	})
+
+	responses := make([]*http.Response, requests)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// postJson can't be used here, a test can only fail fatally from its own goroutine
+			req, _ := http.NewRequest("POST", server.URL+"/api/status", strings.NewReader(`{"transaction_id": "trx"}`))
+			req.AddCookie(cookie)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			t.Cleanup(func() { resp.Body.Close() })
+			responses[i] = resp
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	issued := 0
+	for _, resp := range responses {
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var message IBANStatusResponseMessage
+			if err := json.NewDecoder(resp.Body).Decode(&message); err != nil || message.Jwt == "" {
+				t.Errorf("successful response should carry a jwt: %v", err)
+			}
+			issued++
+		case http.StatusConflict:
+			assertErrorResponse(t, resp, http.StatusConflict, ErrorAlreadyIssued)
+		default:
+			t.Errorf("unexpected status %v", resp.StatusCode)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("exactly one request should receive a jwt, got %v", issued)
+	}
+}
+
+func TestVerifiedAccountIsClearedOnceHandedOut(t *testing.T) {
+	storage := newTestTokenStorage(t)
+	cookie := storeStartedTransaction(t, storage, "trx")
+	status := successStatus("trx")
+	status.IBAN = "NL91 ABNA 0417 1643 00"
+
+	server := newTestServer(t, &ServerState{
+		ibanChecker:   &stubIbanChecker{status: status},
+		jwtCreator:    stubJwtCreator{},
+		tokenStorage:  storage,
+		bankDirectory: newTestBankDirectory(t),
+	})
+
+	resp := postJson(t, server.URL+"/api/status", `{"transaction_id": "trx"}`, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+
+	record, err := storage.RetrieveTransaction(context.Background(), "trx")
+	if err != nil {
+		t.Fatalf("failed to retrieve transaction: %v", err)
+	}
+	if record.IdealStatus != nil {
+		t.Errorf("name and iban should not be kept after issuance, got %+v", record.IdealStatus)
+	}
+	if record.LastStatus != "success" || record.State != TransactionJwtIssued {
+		t.Errorf("record should still show the issuance, got status %v and state %v", record.LastStatus, record.State)
+	}
+	if status.IBAN != "NL91 ABNA 0417 1643 00" {
+		t.Errorf("normalizing should not change the status returned by the checker, got %v", status.IBAN)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// Name of the cookie that binds a transaction to the browser that started it
+const SessionCookieName = "iban_issuer_session"
+
+// The cookie is only needed by the api endpoints
+const sessionCookiePath = "/api"
+
+// newNonce creates a random nonce and the hash of it that is stored with the transaction,
+// so the nonce itself never ends up in the storage
+func newNonce() (nonce string, hash string, err error) {
+	bytes := make([]byte, 32)
+	_, err = rand.Read(bytes)
+	if err != nil {
+		return "", "", err
+	}
+	nonce = base64.RawURLEncoding.EncodeToString(bytes)
+	return nonce, hashNonce(nonce), nil
+}
+
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// setSessionCookie hands the nonce to the browser in a session cookie scripts can't read
+func setSessionCookie(w http.ResponseWriter, nonce string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    nonce,
+		Path:     sessionCookiePath,
+		HttpOnly: true,
+		Secure:   true,
+		// Lax, because the browser returns from the bank through a cross site navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+var errSessionMismatch = errors.New("request doesn't come from the browser that started the transaction")
+
+// verifySessionBinding checks that the request carries the nonce belonging to the transaction
+func verifySessionBinding(r *http.Request, record *TransactionRecord) error {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return errSessionMismatch
+	}
+
+	hash := hashNonce(cookie.Value)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(record.SessionBindingHash)) != 1 {
+		return errSessionMismatch
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newSessionBindingTestServer(t *testing.T) string {
+	t.Helper()
+	server := newTestServer(t, &ServerState{
+		ibanChecker: &stubIbanChecker{
+			transaction: &IdealTransaction{TransactionID: "trx", MerchantReference: "ref"},
+			status:      successStatus("trx"),
+		},
+		jwtCreator:    stubJwtCreator{},
+		tokenStorage:  newTestTokenStorage(t),
+		bankDirectory: newTestBankDirectory(t),
+	})
+	return server.URL
+}
+
+// startIbanCheck starts a transaction and returns the session cookie set for it
+func startIbanCheck(t *testing.T, url string) *http.Cookie {
+	t.Helper()
+	resp := postJson(t, url+"/api/ibancheck", `{"language": "en"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == SessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("starting an iban check should set the session cookie")
+	return nil
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	cookie := startIbanCheck(t, newSessionBindingTestServer(t))
+
+	if cookie.Value == "" {
+		t.Error("session cookie should carry a nonce")
+	}
+	if !cookie.HttpOnly {
+		t.Error("session cookie should be HttpOnly")
+	}
+	if !cookie.Secure {
+		t.Error("session cookie should be Secure")
+	}
+	if cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie should be SameSite=Lax, got %v", cookie.SameSite)
+	}
+	if cookie.Path != "/api" {
+		t.Errorf("session cookie should be limited to /api, got %v", cookie.Path)
+	}
+}
+
+func TestStatusRequiresSessionCookieOfTransaction(t *testing.T) {
+	url := newSessionBindingTestServer(t)
+	cookie := startIbanCheck(t, url)
+
+	t.Run("missing cookie", func(t *testing.T) {
+		resp := postJson(t, url+"/api/status", `{"transaction_id": "trx"}`)
+		assertErrorResponse(t, resp, http.StatusForbidden, ErrorSessionMismatch)
+	})
+
+	t.Run("cookie of another session", func(t *testing.T) {
+		other := &http.Cookie{Name: SessionCookieName, Value: "nonce-of-another-browser"}
+		resp := postJson(t, url+"/api/status", `{"transaction_id": "trx"}`, other)
+		assertErrorResponse(t, resp, http.StatusForbidden, ErrorSessionMismatch)
+	})
+
+	t.Run("cookie of the transaction", func(t *testing.T) {
+		resp := postJson(t, url+"/api/status", `{"transaction_id": "trx"}`, cookie)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status 200, got %v", resp.StatusCode)
+		}
+	})
+}
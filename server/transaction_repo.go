@@ -2,98 +2,469 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	irma "github.com/privacybydesign/irmago"
 	"github.com/redis/go-redis/v9"
 )
 
-type InMemoryTokenStorage struct {
-	TokenMap map[TransactonId]MerchantReference
-	mutex    sync.Mutex
+type TransactionState string
+
+const (
+	// The iDEAL transaction is created and the user is sent to their bank
+	TransactionStarted TransactionState = "started"
+	// The status was requested, but the user didn't finish the transaction yet
+	TransactionPending TransactionState = "pending"
+	// The bank verified the account
+	TransactionVerified TransactionState = "verified"
+	// A signed issuance request or session was handed out for the verified account
+	TransactionJwtIssued TransactionState = "jwt_issued"
+	// The transaction failed or was cancelled by the user
+	TransactionFailed TransactionState = "failed"
+	// The transaction wasn't finished in time
+	TransactionExpired TransactionState = "expired"
+)
+
+// TransactionRecord holds everything that is known about an iDEAL transaction
+// during its lifecycle in this issuer
+type TransactionRecord struct {
+	TransactionID     TransactonId      `json:"transaction_id"`
+	MerchantReference MerchantReference `json:"merchant_reference"`
+	EntranceCode      string            `json:"entrance_code"`
+	Language          string            `json:"language"`
+	// Hash of the nonce in the cookie of the browser that started the transaction
+	SessionBindingHash string           `json:"session_binding_hash"`
+	CreatedAt          time.Time        `json:"created_at"`
+	UpdatedAt          time.Time        `json:"updated_at"`
+	State              TransactionState `json:"state"`
+	StatusPolls        int              `json:"status_polls"`
+	// Status of the transaction as last reported by the iDEAL provider, which can still be open
+	LastStatus string `json:"last_status,omitempty"`
+	// The final status as reported by the iDEAL provider, including the verified account,
+	// so the status can be answered from storage once it's known. It's cleared once the
+	// account is handed out for issuance, so the name and iban aren't kept longer than needed.
+	IdealStatus *TransactionStatus `json:"ideal_status,omitempty"`
+	JwtIssued   bool               `json:"jwt_issued"`
+	// Requestor token of the issuance session, only known when this server started the session.
+	// Session results posted to the callback must belong to this session.
+	IrmaSessionToken irma.RequestorToken `json:"irma_session_token,omitempty"`
+	// Hash of the secret in the callback url of the latest issuance session. Session results
+	// are only accepted with that secret, so results of other sessions can't change the record.
+	IrmaCallbackHash string `json:"irma_callback_hash,omitempty"`
+	// Result of the issuance session, as reported by the IRMA server
+	IssuanceResult irma.ServerStatus `json:"issuance_result,omitempty"`
 }
 
-func NewInMemoryTokenStorage() *InMemoryTokenStorage {
-	return &InMemoryTokenStorage{
-		TokenMap: make(map[TransactonId]MerchantReference),
+// clone returns a copy of the record that shares no pointers with it, so the in-memory
+// storage never hands out records through which the stored one can be changed
+func (record *TransactionRecord) clone() *TransactionRecord {
+	clone := *record
+	if record.IdealStatus != nil {
+		status := *record.IdealStatus
+		clone.IdealStatus = &status
 	}
+	return &clone
 }
 
-type RedisTokenStorage struct {
-	client   *redis.Client
-	username string
+// setIdealStatus records the status reported by the iDEAL provider
+func (record *TransactionRecord) setIdealStatus(status *TransactionStatus) {
+	record.LastStatus = status.Status
+	if transactionStateForStatus(status.Status) != TransactionPending {
+		stored := *status
+		record.IdealStatus = &stored
+	}
+	if !record.JwtIssued {
+		record.State = transactionStateForStatus(status.Status)
+	}
 }
 
-func NewRedisTokenStorage(client *redis.Client, username string) *RedisTokenStorage {
-	return &RedisTokenStorage{client: client, username: username}
+// transactionStateForStatus maps the status reported by the iDEAL provider to the state of the record
+func transactionStateForStatus(status string) TransactionState {
+	switch status {
+	case "success":
+		return TransactionVerified
+	case "failure", "cancelled":
+		return TransactionFailed
+	case "expired":
+		return TransactionExpired
+	default:
+		return TransactionPending
+	}
 }
 
 // Should be safe to use in concurreny
 type TokenStorage interface {
-	StoreToken(transactionId TransactonId, merchantReference MerchantReference) error
-	RetrieveToken(transactionId TransactonId) (MerchantReference, error)
-	RemoveToken(transactionId TransactonId) error
+	// Stores a new record, overwriting an existing record for the same transaction
+	StoreTransaction(ctx context.Context, record *TransactionRecord) error
+	RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error)
+	// Atomically applies the update to the stored record and returns the updated record.
+	// When the update returns an error the record is left untouched.
+	UpdateTransaction(ctx context.Context, transactionId TransactonId, update func(record *TransactionRecord) error) (*TransactionRecord, error)
+	// Atomically marks the transaction as issued and returns the claimed record, so only one
+	// caller can hand out a credential for it. Returns ErrAlreadyClaimed for the other callers.
+	ClaimTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error)
+
+	// Checks whether the storage backend can be used
+	Ping(ctx context.Context) error
+	// Releases the resources of the storage, it shouldn't be used afterwards
+	Close() error
+}
+
+type expiringEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+type InMemoryTokenStorage struct {
+	TransactionMap map[TransactonId]expiringEntry[TransactionRecord]
+	mutex          sync.Mutex
+
+	ttl       time.Duration
+	now       func() time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewInMemoryTokenStorage creates a storage of which the entries expire after the ttl.
+// A background goroutine evicts the expired entries every cleanup interval, until Close is called.
+func NewInMemoryTokenStorage(ttl time.Duration, cleanupInterval time.Duration) *InMemoryTokenStorage {
+	return newInMemoryTokenStorageWithClock(ttl, cleanupInterval, time.Now)
+}
+
+func newInMemoryTokenStorageWithClock(ttl time.Duration, cleanupInterval time.Duration, now func() time.Time) *InMemoryTokenStorage {
+	s := &InMemoryTokenStorage{
+		TransactionMap: make(map[TransactonId]expiringEntry[TransactionRecord]),
+		ttl:            ttl,
+		now:            now,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go s.runJanitor(cleanupInterval)
+	return s
+}
+
+type RedisTokenStorage struct {
+	client   *redis.Client
+	username string
+	ttl      time.Duration
+}
+
+func NewRedisTokenStorage(client *redis.Client, username string, ttl time.Duration) *RedisTokenStorage {
+	return &RedisTokenStorage{client: client, username: username, ttl: ttl}
 }
 
 // ------------------------------------------------------------------------------
 
 func createKey(username string, transactionId TransactonId) string {
-	return fmt.Sprintf("%v:token:%v", username, transactionId)
+	return fmt.Sprintf("%v:transaction:%v", username, transactionId)
 }
 
+// Default time after which stored entries expire
 const Timeout time.Duration = 24 * time.Hour
 
-func (s *RedisTokenStorage) StoreToken(transactionId TransactonId, merchantReference MerchantReference) error {
-	ctx := context.Background()
-	return s.client.Set(ctx, createKey(s.username, transactionId), string(merchantReference), Timeout).Err()
+// Default interval at which the in memory storage evicts expired entries
+const CleanupInterval time.Duration = time.Minute
+
+// Default time a single storage operation may take
+const defaultStorageOperationTimeout = 2 * time.Second
+
+// Number of times an update is retried when the record was changed concurrently
+const maxUpdateAttempts = 10
+
+func (s *RedisTokenStorage) StoreTransaction(ctx context.Context, record *TransactionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return &TokenStorageError{Op: "store", Err: err}
+	}
+
+	err = s.client.Set(ctx, createKey(s.username, record.TransactionID), data, s.ttl).Err()
+	if err != nil {
+		return &TokenStorageError{Op: "store", Err: err}
+	}
+	return nil
+}
+
+func (s *RedisTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	result, err := s.client.Get(ctx, createKey(s.username, transactionId)).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s", ErrTokenNotFound, transactionId)
+	}
+	if err != nil {
+		return nil, &TokenStorageError{Op: "retrieve", Err: err}
+	}
+
+	var record TransactionRecord
+	err = json.Unmarshal(result, &record)
+	if err != nil {
+		return nil, &TokenStorageError{Op: "retrieve", Err: err}
+	}
+	return &record, nil
+}
+
+// UpdateTransaction uses an optimistic redis transaction, which is retried when
+// the record is changed by someone else between reading and writing it
+func (s *RedisTokenStorage) UpdateTransaction(ctx context.Context, transactionId TransactonId, update func(record *TransactionRecord) error) (*TransactionRecord, error) {
+	key := createKey(s.username, transactionId)
+
+	var updated TransactionRecord
+	var updateErr error
+	txf := func(tx *redis.Tx) error {
+		result, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return fmt.Errorf("%w: %s", ErrTokenNotFound, transactionId)
+		}
+		if err != nil {
+			return &TokenStorageError{Op: "update", Err: err}
+		}
+
+		updated = TransactionRecord{}
+		err = json.Unmarshal(result, &updated)
+		if err != nil {
+			return &TokenStorageError{Op: "update", Err: err}
+		}
+
+		updateErr = update(&updated)
+		if updateErr != nil {
+			return updateErr
+		}
+		updated.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&updated)
+		if err != nil {
+			return &TokenStorageError{Op: "update", Err: err}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, redis.KeepTTL)
+			return nil
+		})
+		return err
+	}
+
+	for range maxUpdateAttempts {
+		err := s.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if updateErr != nil {
+			return nil, updateErr
+		}
+		if err != nil {
+			var storageErr *TokenStorageError
+			if errors.As(err, &storageErr) || errors.Is(err, ErrTokenNotFound) {
+				return nil, err
+			}
+			return nil, &TokenStorageError{Op: "update", Err: err}
+		}
+		return &updated, nil
+	}
+	return nil, &TokenStorageError{Op: "update", Err: fmt.Errorf("record for %s kept changing", transactionId)}
 }
 
-func (s *RedisTokenStorage) RetrieveToken(transactionId TransactonId) (MerchantReference, error) {
-	ctx := context.Background()
-	result, err := s.client.Get(ctx, createKey(s.username, transactionId)).Result()
-	fmt.Println("result", result)
+// Checks and sets the jwt_issued field of the record in one go, so concurrent
+// claims can't both succeed. Returns the status and the claimed record.
+var claimScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return {0, ""}
+end
+local record = cjson.decode(data)
+if record["jwt_issued"] then
+	return {2, ""}
+end
+record["jwt_issued"] = true
+record["state"] = ARGV[1]
+record["updated_at"] = ARGV[2]
+local claimed = cjson.encode(record)
+redis.call("SET", KEYS[1], claimed, "KEEPTTL")
+return {1, claimed}
+`)
+
+const (
+	claimNotFound       = 0
+	claimSucceeded      = 1
+	claimAlreadyClaimed = 2
+)
+
+func (s *RedisTokenStorage) ClaimTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	keys := []string{createKey(s.username, transactionId)}
+	now := time.Now().Format(time.RFC3339Nano)
+
+	result, err := claimScript.Run(ctx, s.client, keys, string(TransactionJwtIssued), now).Slice()
 	if err != nil {
-		return "", err
+		return nil, &TokenStorageError{Op: "claim", Err: err}
+	}
+	if len(result) != 2 {
+		return nil, &TokenStorageError{Op: "claim", Err: fmt.Errorf("unexpected script result %v", result)}
+	}
+
+	status, _ := result[0].(int64)
+	switch status {
+	case claimNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrTokenNotFound, transactionId)
+	case claimAlreadyClaimed:
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyClaimed, transactionId)
+	case claimSucceeded:
+		data, _ := result[1].(string)
+		var record TransactionRecord
+		err = json.Unmarshal([]byte(data), &record)
+		if err != nil {
+			return nil, &TokenStorageError{Op: "claim", Err: err}
+		}
+		return &record, nil
+	default:
+		return nil, &TokenStorageError{Op: "claim", Err: fmt.Errorf("unexpected script status %v", status)}
 	}
+}
 
-	return MerchantReference(result), nil
+func (s *RedisTokenStorage) Ping(ctx context.Context) error {
+	err := s.client.Ping(ctx).Err()
+	if err != nil {
+		return &TokenStorageError{Op: "ping", Err: err}
+	}
+	return nil
 }
 
-func (s *RedisTokenStorage) RemoveToken(transactionId TransactonId) error {
-	ctx := context.Background()
-	return s.client.Del(ctx, createKey(s.username, transactionId)).Err()
+func (s *RedisTokenStorage) Close() error {
+	return s.client.Close()
 }
 
 // ------------------------------------------------------------------------------
 
-func (s *InMemoryTokenStorage) StoreToken(transactionId TransactonId, merchantReference MerchantReference) error {
+func (s *InMemoryTokenStorage) StoreTransaction(ctx context.Context, record *TransactionRecord) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.TokenMap[transactionId] = merchantReference
+	s.TransactionMap[record.TransactionID] = expiringEntry[TransactionRecord]{*record.clone(), s.now().Add(s.ttl)}
 	return nil
 }
 
-func (s *InMemoryTokenStorage) RetrieveToken(transactionId TransactonId) (MerchantReference, error) {
+func (s *InMemoryTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if token, ok := s.TokenMap[transactionId]; ok {
-		return token, nil
+	if entry, ok := s.TransactionMap[transactionId]; ok && s.now().Before(entry.expiresAt) {
+		return entry.value.clone(), nil
 	} else {
-		return "", fmt.Errorf("failed to find token for %s", transactionId)
+		return nil, fmt.Errorf("%w: failed to find transaction %s", ErrTokenNotFound, transactionId)
 	}
 }
 
-func (s *InMemoryTokenStorage) RemoveToken(transactionId TransactonId) error {
+func (s *InMemoryTokenStorage) UpdateTransaction(ctx context.Context, transactionId TransactonId, update func(record *TransactionRecord) error) (*TransactionRecord, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if _, ok := s.TokenMap[transactionId]; ok {
-		delete(s.TokenMap, transactionId)
-		return nil
-	} else {
-		return fmt.Errorf("failed to remove token for %s, because it wasn't there", transactionId)
+	entry, ok := s.TransactionMap[transactionId]
+	if !ok || !s.now().Before(entry.expiresAt) {
+		return nil, fmt.Errorf("%w: failed to update transaction %s", ErrTokenNotFound, transactionId)
+	}
+
+	record := entry.value.clone()
+	err := update(record)
+	if err != nil {
+		return nil, err
+	}
+	record.UpdatedAt = s.now()
+
+	entry.value = *record.clone()
+	s.TransactionMap[transactionId] = entry
+	return record, nil
+}
+
+func (s *InMemoryTokenStorage) ClaimTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.TransactionMap[transactionId]
+	if !ok || !s.now().Before(entry.expiresAt) {
+		return nil, fmt.Errorf("%w: failed to claim transaction %s", ErrTokenNotFound, transactionId)
 	}
+	if entry.value.JwtIssued {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyClaimed, transactionId)
+	}
+
+	entry.value.JwtIssued = true
+	entry.value.State = TransactionJwtIssued
+	entry.value.UpdatedAt = s.now()
+	s.TransactionMap[transactionId] = entry
+
+	return entry.value.clone(), nil
+}
+
+func (s *InMemoryTokenStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the janitor goroutine and waits for it to finish
+func (s *InMemoryTokenStorage) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+func (s *InMemoryTokenStorage) runJanitor(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.evictExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// evictExpired removes all entries of which the ttl has passed
+func (s *InMemoryTokenStorage) evictExpired() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	for transactionId, entry := range s.TransactionMap {
+		if !now.Before(entry.expiresAt) {
+			delete(s.TransactionMap, transactionId)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------
+
+// timeoutTokenStorage gives every operation on the wrapped TokenStorage a deadline,
+// on top of the cancellation of the request the context derives from
+type timeoutTokenStorage struct {
+	TokenStorage
+	timeout time.Duration
+}
+
+func (s timeoutTokenStorage) StoreTransaction(ctx context.Context, record *TransactionRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.TokenStorage.StoreTransaction(ctx, record)
+}
+
+func (s timeoutTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.TokenStorage.RetrieveTransaction(ctx, transactionId)
+}
+
+func (s timeoutTokenStorage) UpdateTransaction(ctx context.Context, transactionId TransactonId, update func(record *TransactionRecord) error) (*TransactionRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.TokenStorage.UpdateTransaction(ctx, transactionId, update)
+}
+
+func (s timeoutTokenStorage) ClaimTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.TokenStorage.ClaimTransaction(ctx, transactionId)
 }
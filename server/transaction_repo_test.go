@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when the test advances it
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newClockedTokenStorage(t *testing.T, ttl time.Duration, cleanupInterval time.Duration) (*InMemoryTokenStorage, *testClock) {
+	t.Helper()
+	clock := newTestClock()
+	storage := newInMemoryTokenStorageWithClock(ttl, cleanupInterval, clock.Now)
+	t.Cleanup(func() { storage.Close() })
+	return storage, clock
+}
+
+func TestInMemoryTokenStorageExpiry(t *testing.T) {
+	ctx := context.Background()
+	operations := map[string]func(storage *InMemoryTokenStorage) error{
+		"retrieve": func(storage *InMemoryTokenStorage) error {
+			_, err := storage.RetrieveTransaction(ctx, "trx")
+			return err
+		},
+		"update": func(storage *InMemoryTokenStorage) error {
+			_, err := storage.UpdateTransaction(ctx, "trx", func(record *TransactionRecord) error { return nil })
+			return err
+		},
+		"claim": func(storage *InMemoryTokenStorage) error {
+			_, err := storage.ClaimTransaction(ctx, "trx")
+			return err
+		},
+	}
+
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			storage, clock := newClockedTokenStorage(t, time.Minute, time.Hour)
+			storage.StoreTransaction(ctx, &TransactionRecord{TransactionID: "trx"})
+
+			clock.Advance(59 * time.Second)
+			if err := operation(storage); err != nil {
+				t.Fatalf("transaction should be there before the ttl passed: %v", err)
+			}
+
+			clock.Advance(time.Second)
+			if err := operation(storage); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected ErrTokenNotFound after the ttl passed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInMemoryTokenStorageEvictExpired(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newClockedTokenStorage(t, time.Minute, time.Hour)
+
+	storage.StoreTransaction(ctx, &TransactionRecord{TransactionID: "old"})
+	clock.Advance(30 * time.Second)
+	storage.StoreTransaction(ctx, &TransactionRecord{TransactionID: "new"})
+	clock.Advance(30 * time.Second)
+
+	storage.evictExpired()
+
+	if _, ok := storage.TransactionMap["old"]; ok {
+		t.Error("expired transaction should be evicted")
+	}
+	if _, ok := storage.TransactionMap["new"]; !ok {
+		t.Error("transaction within its ttl should be kept")
+	}
+}
+
+func TestInMemoryTokenStorageJanitorEvicts(t *testing.T) {
+	ctx := context.Background()
+	storage, clock := newClockedTokenStorage(t, time.Minute, time.Millisecond)
+
+	storage.StoreTransaction(ctx, &TransactionRecord{TransactionID: "trx"})
+	clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		storage.mutex.Lock()
+		remaining := len(storage.TransactionMap)
+		storage.mutex.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("janitor should evict the expired transaction")
+}
+
+func TestInMemoryTokenStorageCloseStopsJanitor(t *testing.T) {
+	storage := NewInMemoryTokenStorage(time.Minute, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storage.Close()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-storage.done:
+	default:
+		t.Error("janitor should have stopped after Close")
+	}
+	// Closing again is a no-op
+	storage.Close()
+}
+
+// blockingTokenStorage only returns when the context of the operation ends
+type blockingTokenStorage struct {
+	*InMemoryTokenStorage
+}
+
+func (s blockingTokenStorage) RetrieveTransaction(ctx context.Context, transactionId TransactonId) (*TransactionRecord, error) {
+	<-ctx.Done()
+	return nil, &TokenStorageError{Op: "retrieve", Err: ctx.Err()}
+}
+
+func TestTimeoutTokenStorageAbortsOperation(t *testing.T) {
+	storage := timeoutTokenStorage{blockingTokenStorage{newTestTokenStorage(t)}, 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := storage.RetrieveTransaction(context.Background(), "trx")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("operation should stop at the deadline, took %v", elapsed)
+	}
+}
+
+func TestTimeoutTokenStorageIsCancelledWithTheRequest(t *testing.T) {
+	storage := timeoutTokenStorage{blockingTokenStorage{newTestTokenStorage(t)}, time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := storage.RetrieveTransaction(ctx, "trx")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestInMemoryTokenStorageDoesNotShareStatus(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newClockedTokenStorage(t, time.Minute, time.Hour)
+
+	stored := &TransactionRecord{TransactionID: "trx", IdealStatus: successStatus("trx")}
+	storage.StoreTransaction(ctx, stored)
+	stored.IdealStatus.IBAN = "changed after store"
+
+	retrieved, _ := storage.RetrieveTransaction(ctx, "trx")
+	retrieved.IdealStatus.IBAN = "changed after retrieve"
+
+	updated, _ := storage.UpdateTransaction(ctx, "trx", func(record *TransactionRecord) error { return nil })
+	updated.IdealStatus.IBAN = "changed after update"
+
+	claimed, _ := storage.ClaimTransaction(ctx, "trx")
+	claimed.IdealStatus.IBAN = "changed after claim"
+
+	record, err := storage.RetrieveTransaction(ctx, "trx")
+	if err != nil {
+		t.Fatalf("failed to retrieve transaction: %v", err)
+	}
+	if record.IdealStatus.IBAN != "NL91ABNA0417164300" {
+		t.Errorf("stored status should only change through an update, got iban %v", record.IdealStatus.IBAN)
+	}
+}